@@ -0,0 +1,489 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netleapio/zappy-framework/protocol"
+)
+
+type jsonReading struct {
+	Value        float64
+	Raw          *uint16  `json:",omitempty"`
+	Uncalibrated *float64 `json:",omitempty"`
+	Unfiltered   *float64 `json:",omitempty"`
+	Received     time.Time
+	Stale        bool
+}
+
+type jsonDevice struct {
+	DeviceID string
+	Name     string
+	Model    string
+	Profile  string
+	Zone     string `json:",omitempty"`
+	LastSeen time.Time
+	Alerts   []string
+	Readings map[string]jsonReading
+	Rejected map[string]uint64 `json:",omitempty"`
+	Battery  *BatteryStatus    `json:",omitempty"`
+	Traffic  *TrafficStats     `json:",omitempty"`
+}
+
+// DefaultAPIListen is where the API listens unless configured otherwise.
+// The API is unauthenticated, so only local clients are accepted.
+const DefaultAPIListen = "localhost:8081"
+
+// API provides HTTP endpoints for inspecting and managing devices.  It has
+// its own listener, separate from metrics and the web UI.
+type API struct {
+	manager  *DeviceManager
+	downlink *Downlink
+	listen   string
+	mux      *http.ServeMux
+}
+
+func NewAPI(cfg *APISettings, manager *DeviceManager, downlink *Downlink) *API {
+	listen := cfg.Listen
+	if listen == "" {
+		listen = DefaultAPIListen
+	}
+
+	return &API{
+		manager:  manager,
+		downlink: downlink,
+		listen:   listen,
+		mux:      http.NewServeMux(),
+	}
+}
+
+// HandleFunc adds an endpoint to the API
+func (a *API) HandleFunc(pattern string, handler func(http.ResponseWriter, *http.Request)) {
+	a.mux.HandleFunc(pattern, handler)
+}
+
+func (a *API) Start() {
+	a.HandleFunc("/api/devices", a.handleDevices)
+	a.HandleFunc("/api/devices/", a.handleDevice)
+	a.HandleFunc("/api/alerts", a.handleAlerts)
+	a.HandleFunc("/api/onboarding", a.handleOnboarding)
+	a.HandleFunc("/api/onboarding/", a.handleOnboardingAction)
+	a.HandleFunc("/api/zones", a.handleZones)
+	a.HandleFunc("/api/zones/", a.handleZone)
+	a.HandleFunc("/api/events", a.handleEvents)
+	a.HandleFunc("/api/events/tail", a.handleEventsTail)
+
+	go func() {
+		log.Fatal(http.ListenAndServe(a.listen, a.mux))
+	}()
+}
+
+// handleDevices serves GET /api/devices
+func (a *API) handleDevices(w http.ResponseWriter, r *http.Request) {
+	ids := []uint16{}
+	devices := map[uint16]jsonDevice{}
+
+	a.manager.VisitDevices(func(d *DeviceState) {
+		ids = append(ids, d.id)
+		devices[d.id] = newJSONDevice(d, a.manager.profileFor(d), a.manager.nameOf(d))
+	})
+
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	result := make([]jsonDevice, 0, len(ids))
+	for _, id := range ids {
+		result = append(result, devices[id])
+	}
+
+	writeJSON(w, result)
+}
+
+// handleDevice serves:
+//
+//	GET    /api/devices/{id}
+//	DELETE /api/devices/{id}, forgetting a decommissioned device
+//	POST /api/devices/{id}/calibrate?sensor=&reference=&mode=offset|gain|point
+//	POST /api/devices/{id}/reassign?to={new id}
+func (a *API) handleDevice(w http.ResponseWriter, r *http.Request) {
+	id, action, ok := parseDevicePath(r.URL.Path, "/api/devices/")
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch {
+	case action == "" && r.Method == http.MethodGet:
+		var result *jsonDevice
+		a.manager.VisitDevices(func(d *DeviceState) {
+			if d.id == id {
+				jd := newJSONDevice(d, a.manager.profileFor(d), a.manager.nameOf(d))
+				result = &jd
+			}
+		})
+
+		if result == nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		if b, ok := a.manager.BatteryStatus(id); ok {
+			result.Battery = &b
+		}
+		if t, ok := a.manager.TrafficStats(id); ok {
+			result.Traffic = &t
+		}
+
+		writeJSON(w, result)
+	case action == "" && r.Method == http.MethodDelete:
+		err := a.manager.Forget(id)
+		if errors.Is(err, ErrUnknownDevice) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case action == "calibrate" && r.Method == http.MethodPost:
+		q := r.URL.Query()
+
+		reference, err := strconv.ParseFloat(q.Get("reference"), 64)
+		if err != nil {
+			http.Error(w, "invalid reference value", http.StatusBadRequest)
+			return
+		}
+
+		c, err := a.manager.Calibrate(id, q.Get("sensor"), q.Get("mode"), reference)
+		if errors.Is(err, ErrUnknownDevice) {
+			http.NotFound(w, r)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		writeJSON(w, c)
+	case action == "reassign" && r.Method == http.MethodPost:
+		newID, err := strconv.ParseUint(r.URL.Query().Get("to"), 10, 16)
+		if err != nil {
+			http.Error(w, "invalid device id", http.StatusBadRequest)
+			return
+		}
+
+		if !a.downlink.Enabled() {
+			http.Error(w, ErrDownlinkDisabled.Error(), http.StatusNotImplemented)
+			return
+		}
+
+		err = a.manager.PrepareReassign(id, uint16(newID))
+		if errors.Is(err, ErrUnknownDevice) {
+			http.NotFound(w, r)
+			return
+		} else if errors.Is(err, ErrDeviceIDInUse) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		err = a.downlink.Queue(id, ConfigDeviceID, uint16(newID))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		writeJSON(w, a.downlink.Pending(id))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// handleAlerts serves GET /api/alerts, the active controller alerts
+func (a *API) handleAlerts(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.manager.ControllerAlerts().Active())
+}
+
+// handleOnboarding serves GET /api/onboarding, the pending and rejected
+// devices
+func (a *API) handleOnboarding(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.manager.Onboarding())
+}
+
+// handleOnboardingAction serves:
+//
+//	POST /api/onboarding/approve?device={id}
+//	POST /api/onboarding/reject?device={id}
+//	POST /api/onboarding/pair?duration=5m
+func (a *API) handleOnboardingAction(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	q := r.URL.Query()
+	action := strings.TrimPrefix(r.URL.Path, "/api/onboarding/")
+
+	if action == "pair" {
+		d, err := time.ParseDuration(q.Get("duration"))
+		if err != nil {
+			http.Error(w, "invalid duration", http.StatusBadRequest)
+			return
+		}
+
+		a.manager.OpenPairing(d)
+		writeJSON(w, a.manager.Onboarding())
+		return
+	}
+
+	id, err := strconv.ParseUint(q.Get("device"), 10, 16)
+	if err != nil {
+		http.Error(w, "invalid device id", http.StatusBadRequest)
+		return
+	}
+
+	switch action {
+	case "approve":
+		err = a.manager.Approve(uint16(id))
+	case "reject":
+		err = a.manager.Reject(uint16(id))
+	default:
+		http.NotFound(w, r)
+		return
+	}
+
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, a.manager.Onboarding())
+}
+
+// parseEventQuery reads ?device=&type=&since=&until=&limit=, where times
+// are RFC 3339 or a duration before now such as "12h"
+func parseEventQuery(r *http.Request) (EventQuery, error) {
+	q := r.URL.Query()
+	result := EventQuery{Type: q.Get("type")}
+
+	if s := q.Get("device"); s != "" {
+		id, err := strconv.ParseUint(s, 10, 16)
+		if err != nil {
+			return result, errors.New("invalid device id")
+		}
+		device := uint16(id)
+		result.Device = &device
+	}
+
+	parseTime := func(s string) (time.Time, error) {
+		if s == "" {
+			return time.Time{}, nil
+		}
+		if d, err := time.ParseDuration(s); err == nil {
+			return time.Now().Add(-d), nil
+		}
+		return time.Parse(time.RFC3339, s)
+	}
+
+	var err error
+	result.Since, err = parseTime(q.Get("since"))
+	if err != nil {
+		return result, errors.New("invalid since time")
+	}
+	result.Until, err = parseTime(q.Get("until"))
+	if err != nil {
+		return result, errors.New("invalid until time")
+	}
+
+	if s := q.Get("limit"); s != "" {
+		result.Limit, err = strconv.Atoi(s)
+		if err != nil {
+			return result, errors.New("invalid limit")
+		}
+	}
+
+	return result, nil
+}
+
+// handleEvents serves GET /api/events?device=&type=&since=&until=&limit=,
+// matching events from the event log oldest first
+func (a *API) handleEvents(w http.ResponseWriter, r *http.Request) {
+	q, err := parseEventQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	events, err := a.manager.Events().Query(q)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeJSON(w, events)
+}
+
+// handleEventsTail serves GET /api/events/tail?device=&type=, streaming
+// new events as JSON lines until the client disconnects
+func (a *API) handleEventsTail(w http.ResponseWriter, r *http.Request) {
+	q, err := parseEventQuery(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+
+	events := a.manager.Events()
+	ch := events.Subscribe()
+	defer events.Unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	enc := json.NewEncoder(w)
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			if !q.matches(&e) {
+				continue
+			}
+			if enc.Encode(&e) != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// handleZones serves GET /api/zones, the members of each zone
+func (a *API) handleZones(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, a.manager.Zones())
+}
+
+// handleZone serves:
+//
+//	PUT    /api/zones/{name}?devices=1,2,3
+//	DELETE /api/zones/{name}
+func (a *API) handleZone(w http.ResponseWriter, r *http.Request) {
+	name := strings.TrimPrefix(r.URL.Path, "/api/zones/")
+	if name == "" || strings.Contains(name, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	switch r.Method {
+	case http.MethodPut:
+		devices := []uint16{}
+		for _, s := range strings.Split(r.URL.Query().Get("devices"), ",") {
+			if s == "" {
+				continue
+			}
+
+			id, err := strconv.ParseUint(s, 10, 16)
+			if err != nil {
+				http.Error(w, "invalid device id", http.StatusBadRequest)
+				return
+			}
+			devices = append(devices, uint16(id))
+		}
+
+		err := a.manager.SetZone(name, devices)
+		if errors.Is(err, ErrDeviceIDInUse) {
+			http.Error(w, err.Error(), http.StatusConflict)
+			return
+		} else if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodDelete:
+		if !a.manager.RemoveZone(name) {
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func newJSONDevice(d *DeviceState, profile *DeviceProfile, name string) jsonDevice {
+	result := jsonDevice{
+		DeviceID: strconv.Itoa(int(d.id)),
+		Name:     name,
+		Model:    profile.Model,
+		Profile:  profile.Name,
+		Zone:     d.zone,
+		LastSeen: d.lastSeen,
+		Alerts:   d.alerts.Strings(),
+		Readings: map[string]jsonReading{},
+	}
+
+	for t, r := range d.sensors {
+		md := sensorMetadata[t]
+		if md == nil {
+			continue
+		}
+
+		jr := jsonReading{
+			Value:    r.Value,
+			Received: r.Received,
+			Stale:    r.Stale,
+		}
+
+		// Derived readings have no raw value
+		if pmd := protocol.SensorMetadata[t]; pmd != nil {
+			raw := r.Raw
+			uncalibrated := sensorValue(pmd, r.Raw)
+			unfiltered := r.Unfiltered
+			jr.Raw = &raw
+			jr.Uncalibrated = &uncalibrated
+			jr.Unfiltered = &unfiltered
+		}
+
+		result.Readings[md.Name] = jr
+	}
+
+	for t, n := range d.rejected {
+		if result.Rejected == nil {
+			result.Rejected = map[string]uint64{}
+		}
+		result.Rejected[sensorMetadata[t].Name] = n
+	}
+
+	return result
+}
+
+// parseDevicePath splits '{prefix}{id}[/{action}]'
+func parseDevicePath(path string, prefix string) (uint16, string, bool) {
+	idStr, action, _ := strings.Cut(strings.TrimPrefix(path, prefix), "/")
+
+	id, err := strconv.ParseUint(idStr, 10, 16)
+	if err != nil {
+		return 0, "", false
+	}
+
+	return uint16(id), action, true
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(v)
+	if err != nil {
+		log.Printf("http: error writing response: %v", err)
+	}
+}
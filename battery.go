@@ -0,0 +1,277 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"time"
+
+	"github.com/netleapio/zappy-framework/protocol"
+)
+
+// Sensor types for battery estimates
+const (
+	SensorTypeBatteryLevel protocol.SensorType = 0xA0 + iota
+	SensorTypeBatteryDaysRemaining
+)
+
+var batterySensorMetadata = map[protocol.SensorType]*protocol.SensorInfo{
+	SensorTypeBatteryLevel:         {Name: "battery_level", Unit: "percent", Mult: 1, Div: 1},
+	SensorTypeBatteryDaysRemaining: {Name: "battery_days_remaining", Unit: "days", Mult: 1, Div: 1},
+}
+
+const (
+	DefaultBatteryChemistry = "liion"
+
+	// batterySmoothing is the weight of each new voltage in the moving
+	// average, which smooths out load and temperature swings
+	batterySmoothing = 0.05
+
+	batterySamplePeriod = 1 * time.Hour
+	batteryHistoryLen   = 30 * 24
+
+	// batteryMinSpan of history is needed before estimating remaining life
+	batteryMinSpan = 24 * time.Hour
+
+	// batteryReplacedJump in percent indicates a fresh battery, if it
+	// holds for batteryReplacedSamples readings in a row
+	batteryReplacedJump    = 20.0
+	batteryReplacedSamples = 3
+
+	batteryReferenceTemp = 25.0
+)
+
+// batteryProfile maps (temperature compensated) pack voltage to state of
+// charge for a battery chemistry
+type batteryProfile struct {
+	// curve of [volts, percent], highest voltage first
+	curve [][2]float64
+
+	// tempCoeff is the change in pack voltage per °C
+	tempCoeff float64
+}
+
+var batteryProfiles = map[string]batteryProfile{
+	// Single Li-ion/LiPo cell
+	"liion": {
+		curve: [][2]float64{
+			{4.20, 100}, {4.10, 90}, {4.00, 80}, {3.90, 65}, {3.80, 50},
+			{3.70, 30}, {3.60, 15}, {3.50, 5}, {3.30, 0},
+		},
+		tempCoeff: 0.001,
+	},
+	// Single LiFePO4 cell
+	"lifepo4": {
+		curve: [][2]float64{
+			{3.40, 100}, {3.35, 90}, {3.30, 70}, {3.25, 40}, {3.20, 20},
+			{3.00, 10}, {2.50, 0},
+		},
+		tempCoeff: 0.0005,
+	},
+	// Two alkaline AA/AAA cells in series
+	"alkaline": {
+		curve: [][2]float64{
+			{3.20, 100}, {3.00, 90}, {2.80, 70}, {2.60, 45}, {2.40, 25},
+			{2.20, 10}, {2.00, 0},
+		},
+		tempCoeff: 0.002,
+	},
+	// Two NiMH cells in series
+	"nimh": {
+		curve: [][2]float64{
+			{2.80, 100}, {2.65, 85}, {2.55, 65}, {2.50, 45}, {2.45, 25},
+			{2.35, 10}, {2.00, 0},
+		},
+		tempCoeff: 0.001,
+	},
+}
+
+// percent interpolates the state of charge for a voltage
+func (p *batteryProfile) percent(volts float64) float64 {
+	c := p.curve
+	if volts >= c[0][0] {
+		return c[0][1]
+	}
+
+	for i := 1; i < len(c); i++ {
+		if volts >= c[i][0] {
+			hi, lo := c[i-1], c[i]
+			return lo[1] + (volts-lo[0])*(hi[1]-lo[1])/(hi[0]-lo[0])
+		}
+	}
+
+	return c[len(c)-1][1]
+}
+
+type batterySample struct {
+	time    time.Time
+	percent float64
+}
+
+// batteryState tracks one device's battery.  It is kept by the manager
+// rather than the device, so that history survives device timeouts.
+type batteryState struct {
+	volts      float64
+	percent    float64
+	samples    []batterySample
+	replacedAt time.Time
+
+	// jumps counts consecutive readings well above the smoothed voltage
+	jumps int
+}
+
+// BatteryStatus summarises the battery of a device
+type BatteryStatus struct {
+	Chemistry       string
+	Volts           float64
+	Percent         float64
+	DischargePerDay *float64  `json:",omitempty"`
+	DaysRemaining   *float64  `json:",omitempty"`
+	ReplacedAt      time.Time `json:",omitempty"`
+}
+
+func batteryChemistry(settings *DeviceSettings) string {
+	if settings.BatteryChemistry == "" {
+		return DefaultBatteryChemistry
+	}
+
+	return settings.BatteryChemistry
+}
+
+// updateBattery updates the battery estimates of a device from a new
+// voltage reading.  Must be called with the lock held.
+func (m *DeviceManager) updateBattery(d *DeviceState, now time.Time) {
+	r, ok := d.sensors[protocol.SensorTypeBattVolts]
+	if !ok || !r.Received.Equal(now) {
+		return
+	}
+
+	profile := batteryProfiles[batteryChemistry(m.deviceSettings(d.id))]
+
+	// Cell voltage sags in the cold, so compensate to the reference
+	// temperature when the device reports temperature
+	volts := r.Value
+	if t, ok := d.sensors[protocol.SensorTypeTemperature]; ok && !t.Stale {
+		volts += profile.tempCoeff * (batteryReferenceTemp - t.Value)
+	}
+
+	b, ok := m.batteries[d.id]
+	if !ok {
+		b = &batteryState{volts: volts}
+		m.batteries[d.id] = b
+	}
+
+	switch {
+	case profile.percent(volts)-profile.percent(b.volts) <= batteryReplacedJump:
+		b.jumps = 0
+		b.volts += batterySmoothing * (volts - b.volts)
+	case b.jumps+1 < batteryReplacedSamples:
+		// A single high reading may be a glitch, so leave the average
+		// alone until the jump holds
+		b.jumps++
+	default:
+		log.Printf("Device #%04x: battery replaced (%.3f V -> %.3f V)", d.id, b.volts, volts)
+		b.jumps = 0
+		b.volts = volts
+		b.samples = nil
+		b.replacedAt = now
+	}
+	b.percent = profile.percent(b.volts)
+
+	if n := len(b.samples); n == 0 || now.Sub(b.samples[n-1].time) >= batterySamplePeriod {
+		b.samples = append(b.samples, batterySample{time: now, percent: b.percent})
+		if len(b.samples) > batteryHistoryLen {
+			b.samples = b.samples[len(b.samples)-batteryHistoryLen:]
+		}
+	}
+
+	d.sensors[SensorTypeBatteryLevel] = Reading{Value: b.percent, Received: now}
+
+	// Keep the last estimate, marked stale, while there is none so that
+	// outputs show it as unavailable rather than removing it
+	if days, ok := b.daysRemaining(); ok {
+		d.sensors[SensorTypeBatteryDaysRemaining] = Reading{Value: days, Received: now}
+	} else if r, ok := d.sensors[SensorTypeBatteryDaysRemaining]; ok && !r.Stale {
+		r.Stale = true
+		d.sensors[SensorTypeBatteryDaysRemaining] = r
+	}
+}
+
+// dischargeRate fits a least-squares line to the sampled state of charge,
+// returning the slope in percent per day
+func (b *batteryState) dischargeRate() (float64, bool) {
+	n := len(b.samples)
+	if n < 2 || b.samples[n-1].time.Sub(b.samples[0].time) < batteryMinSpan {
+		return 0, false
+	}
+
+	origin := b.samples[0].time
+	var sx, sy, sxx, sxy float64
+	for _, s := range b.samples {
+		x := s.time.Sub(origin).Hours() / 24
+		sx += x
+		sy += s.percent
+		sxx += x * x
+		sxy += x * s.percent
+	}
+
+	denom := float64(n)*sxx - sx*sx
+	if denom == 0 {
+		return 0, false
+	}
+
+	return (float64(n)*sxy - sx*sy) / denom, true
+}
+
+// daysRemaining extrapolates the discharge rate to empty, which is only
+// possible while the battery is discharging
+func (b *batteryState) daysRemaining() (float64, bool) {
+	rate, ok := b.dischargeRate()
+	if !ok || rate >= -0.01 {
+		return 0, false
+	}
+
+	return b.percent / -rate, true
+}
+
+// BatteryStatus gets the battery estimates of a device
+func (m *DeviceManager) BatteryStatus(id uint16) (BatteryStatus, bool) {
+	result := BatteryStatus{}
+	found := false
+
+	m.doLocked(func() error {
+		b, ok := m.batteries[id]
+		if !ok {
+			return nil
+		}
+
+		found = true
+		result = BatteryStatus{
+			Chemistry:  batteryChemistry(m.deviceSettings(id)),
+			Volts:      b.volts,
+			Percent:    b.percent,
+			ReplacedAt: b.replacedAt,
+		}
+
+		if rate, ok := b.dischargeRate(); ok {
+			result.DischargePerDay = &rate
+		}
+		if days, ok := b.daysRemaining(); ok {
+			result.DaysRemaining = &days
+		}
+
+		return nil
+	})
+
+	return result, found
+}
+
+// batteryChemistries lists the names of the battery profiles
+func batteryChemistries() []string {
+	result := []string{}
+	for name := range batteryProfiles {
+		result = append(result, name)
+	}
+	sort.Strings(result)
+
+	return result
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/netleapio/zappy-framework/protocol"
+)
+
+// Calibration corrects the readings of one sensor on one device.
+//
+// If Points are given they form a lookup table of [measured, actual]
+// pairs which is linearly interpolated (and extrapolated from the end
+// segments).  Otherwise the reading is corrected as value*Gain + Offset.
+type Calibration struct {
+	Offset float64      `json:"offset,omitempty"`
+	Gain   *float64     `json:"gain,omitempty"`
+	Points [][2]float64 `json:"points,omitempty"`
+}
+
+// Calibration modes for computing a calibration from a reference reading
+const (
+	CalibrateOffset = "offset"
+	CalibrateGain   = "gain"
+	CalibratePoint  = "point"
+)
+
+var (
+	ErrUnknownDevice  = errors.New("unknown device")
+	ErrNoReading      = errors.New("no reading for sensor")
+	ErrCalibrateMode  = errors.New("unknown calibration mode")
+	ErrCalibrateValue = errors.New("cannot calibrate gain from a zero reading")
+)
+
+func (c *Calibration) gain() float64 {
+	if c.Gain == nil {
+		return 1
+	}
+
+	return *c.Gain
+}
+
+// Apply corrects a measured value
+func (c *Calibration) Apply(v float64) float64 {
+	switch len(c.Points) {
+	case 0:
+		return v*c.gain() + c.Offset
+	case 1:
+		return v + c.Points[0][1] - c.Points[0][0]
+	}
+
+	// Find the segment containing v, using the end segments outside the
+	// range of the table
+	i := sort.Search(len(c.Points), func(i int) bool { return c.Points[i][0] >= v })
+	if i == 0 {
+		i = 1
+	} else if i == len(c.Points) {
+		i = len(c.Points) - 1
+	}
+
+	lo, hi := c.Points[i-1], c.Points[i]
+	if hi[0] == lo[0] {
+		return v + lo[1] - lo[0]
+	}
+
+	return lo[1] + (v-lo[0])*(hi[1]-lo[1])/(hi[0]-lo[0])
+}
+
+// withReference returns a copy of the calibration adjusted so that the
+// 'measured' value reads as 'reference'
+func (c Calibration) withReference(mode string, measured float64, reference float64) (Calibration, error) {
+	switch mode {
+	case CalibrateOffset, "":
+		c.Points = nil
+		c.Offset = reference - measured*c.gain()
+	case CalibrateGain:
+		if measured == 0 {
+			return c, ErrCalibrateValue
+		}
+		gain := (reference - c.Offset) / measured
+		c.Points = nil
+		c.Gain = &gain
+	case CalibratePoint:
+		points := [][2]float64{}
+		for _, p := range c.Points {
+			if p[0] != measured {
+				points = append(points, p)
+			}
+		}
+		points = append(points, [2]float64{measured, reference})
+		sort.Slice(points, func(i, j int) bool { return points[i][0] < points[j][0] })
+		c.Points = points
+	default:
+		return c, fmt.Errorf("%w '%s'", ErrCalibrateMode, mode)
+	}
+
+	return c, nil
+}
+
+// calibrate applies the device's calibration for a sensor (if any)
+func (m *DeviceManager) calibrate(id uint16, md *protocol.SensorInfo, v float64) float64 {
+	c, ok := m.deviceSettings(id).Calibration[md.Name]
+	if !ok {
+		return v
+	}
+
+	return c.Apply(v)
+}
+
+// Calibrate computes and applies (until restart) a calibration for a sensor
+// from a reference value for its latest reading.  The result should be
+// copied to the config to make it permanent.
+func (m *DeviceManager) Calibrate(id uint16, sensor string, mode string, reference float64) (Calibration, error) {
+	result := Calibration{}
+
+	err := m.doLocked(func() error {
+		t, ok := sensorTypeByName(sensor)
+		if !ok {
+			return fmt.Errorf("unknown sensor type '%s'", sensor)
+		}
+
+		d, ok := m.devices[id]
+		if !ok {
+			return ErrUnknownDevice
+		}
+
+		r, ok := d.sensors[t]
+		md := protocol.SensorMetadata[t]
+		if !ok || md == nil {
+			return fmt.Errorf("%w '%s'", ErrNoReading, sensor)
+		}
+
+		settings, ok := m.settings[id]
+		if !ok {
+			settings = &DeviceSettings{}
+			m.settings[id] = settings
+		}
+		if settings.Calibration == nil {
+			settings.Calibration = map[string]Calibration{}
+		}
+
+		c, err := settings.Calibration[sensor].withReference(mode, sensorValue(md, r.Raw), reference)
+		if err != nil {
+			return err
+		}
+
+		settings.Calibration[sensor] = c
+		result = c
+
+		return nil
+	})
+
+	return result, err
+}
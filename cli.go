@@ -0,0 +1,177 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+const DefaultAPIAddress = "http://" + DefaultAPIListen
+
+// apiClient runs CLI commands against the HTTP API of a running
+// controller
+type apiClient struct {
+	base string
+	http *http.Client
+}
+
+func newAPIClient(base string) *apiClient {
+	return &apiClient{
+		base: base,
+		http: &http.Client{Timeout: 10 * time.Second},
+	}
+}
+
+// call makes a request, pretty-printing the JSON response to stdout
+func (c *apiClient) call(method string, path string, query url.Values) error {
+	u := c.base + path
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return err
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	if len(body) == 0 {
+		return nil
+	}
+
+	out := bytes.Buffer{}
+	if json.Indent(&out, body, "", "  ") != nil {
+		_, err = os.Stdout.Write(body)
+		return err
+	}
+
+	out.WriteByte('\n')
+	_, err = out.WriteTo(os.Stdout)
+	return err
+}
+
+// stream makes a request, copying the response to stdout as it arrives
+func (c *apiClient) stream(path string, query url.Values) error {
+	resp, err := http.Get(c.base + path + "?" + query.Encode())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		body, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("%s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+
+	_, err = io.Copy(os.Stdout, resp.Body)
+	return err
+}
+
+// runEvents queries or follows the event log
+func runEvents(c *apiClient, args []string) error {
+	flags := flag.NewFlagSet("events", flag.ContinueOnError)
+	device := flags.String("device", "", "only events for a device id")
+	eventType := flags.String("type", "", "only events of a type, eg. reading-rejected")
+	since := flags.String("since", "", "only events after a time (RFC 3339) or duration ago, eg. 12h")
+	until := flags.String("until", "", "only events before a time (RFC 3339) or duration ago")
+	limit := flags.Int("limit", 100, "maximum number of events, the most recent are shown")
+	follow := flags.Bool("f", false, "follow new events")
+
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	q := url.Values{}
+	for k, v := range map[string]string{"device": *device, "type": *eventType} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+
+	if *follow {
+		return c.stream("/api/events/tail", q)
+	}
+
+	for k, v := range map[string]string{"since": *since, "until": *until} {
+		if v != "" {
+			q.Set(k, v)
+		}
+	}
+	q.Set("limit", strconv.Itoa(*limit))
+
+	return c.call(http.MethodGet, "/api/events", q)
+}
+
+// runCLI handles the commands that manage a running controller, returning
+// false if the command is not one of them
+func runCLI(api string, cmd string, args []string) (bool, error) {
+	c := newAPIClient(api)
+
+	deviceArg := func() (url.Values, error) {
+		if len(args) < 1 {
+			return nil, fmt.Errorf("%s: missing device id", cmd)
+		}
+		if _, err := strconv.ParseUint(args[0], 10, 16); err != nil {
+			return nil, fmt.Errorf("%s: invalid device id '%s'", cmd, args[0])
+		}
+		return url.Values{"device": {args[0]}}, nil
+	}
+
+	switch cmd {
+	case "pending":
+		return true, c.call(http.MethodGet, "/api/onboarding", nil)
+	case "approve", "reject":
+		q, err := deviceArg()
+		if err != nil {
+			return true, err
+		}
+		return true, c.call(http.MethodPost, "/api/onboarding/"+cmd, q)
+	case "pair":
+		duration := "5m"
+		if len(args) > 0 {
+			duration = args[0]
+		}
+		return true, c.call(http.MethodPost, "/api/onboarding/pair", url.Values{"duration": {duration}})
+	case "forget":
+		q, err := deviceArg()
+		if err != nil {
+			return true, err
+		}
+		return true, c.call(http.MethodDelete, "/api/devices/"+q.Get("device"), nil)
+	case "events":
+		return true, runEvents(c, args)
+	case "reassign":
+		q, err := deviceArg()
+		if err != nil {
+			return true, err
+		}
+		if len(args) < 2 {
+			return true, fmt.Errorf("%s: missing new device id", cmd)
+		}
+		return true, c.call(http.MethodPost, "/api/devices/"+q.Get("device")+"/reassign", url.Values{"to": {args[1]}})
+	}
+
+	return false, nil
+}
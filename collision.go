@@ -0,0 +1,150 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/netleapio/zappy-framework/protocol"
+)
+
+const (
+	// collisionWindow is the number of reports the heuristics look back over
+	collisionWindow = 8
+
+	// collisionIntervalRatio is the fraction of the expected interval below
+	// which the median report interval suggests two devices
+	collisionIntervalRatio = 0.6
+
+	// collisionMinZigzags is how many alternating steps in the window mark
+	// a sensor as flip-flopping between two sources
+	collisionMinZigzags = 5
+)
+
+var (
+	ErrDeviceIDInUse = errors.New("device id in use")
+)
+
+// collisionState keeps the recent history of a device used to spot two
+// devices sharing an ID
+type collisionState struct {
+	arrivals []time.Time
+	versions []uint16
+	raw      map[protocol.SensorType][]uint16
+}
+
+func newCollisionState() *collisionState {
+	return &collisionState{raw: map[protocol.SensorType][]uint16{}}
+}
+
+func collisionAlertName(id uint16) string {
+	return fmt.Sprintf("device-%d-collision", id)
+}
+
+// detectCollision records a report and checks whether it looks like it
+// came from a different device to the previous one with the same ID,
+// raising or clearing a controller alert.  Must be called with the lock
+// held.
+func (m *DeviceManager) detectCollision(d *DeviceState, rpt *protocol.SensorReport, now time.Time) {
+	c := d.collision
+
+	c.arrivals = appendWindow(c.arrivals, now, collisionWindow+1)
+	c.versions = appendWindow(c.versions, rpt.Packet().Version(), collisionWindow)
+	for t, v := range rpt.AllReadings() {
+		c.raw[t] = appendWindow(c.raw[t], v, collisionWindow)
+	}
+
+	evidence := []string{}
+
+	if len(c.arrivals) > collisionWindow {
+		intervals := make([]float64, 0, len(c.arrivals)-1)
+		for i := 1; i < len(c.arrivals); i++ {
+			intervals = append(intervals, c.arrivals[i].Sub(c.arrivals[i-1]).Seconds())
+		}
+		sort.Float64s(intervals)
+
+		expected := m.profileFor(d).ExpectedInterval
+		median := time.Duration(intervals[len(intervals)/2] * float64(time.Second))
+		if median < time.Duration(collisionIntervalRatio*float64(expected)) {
+			evidence = append(evidence, fmt.Sprintf("median report interval %v, expected %v",
+				median.Round(time.Second), expected))
+		}
+	}
+
+	changes := 0
+	for i := 1; i < len(c.versions); i++ {
+		if c.versions[i] != c.versions[i-1] {
+			changes++
+		}
+	}
+	if changes > 1 {
+		evidence = append(evidence, fmt.Sprintf("firmware version changed %d times in %d reports: %v",
+			changes, len(c.versions), c.versions))
+	}
+
+	for t, values := range c.raw {
+		if zigzags(values) >= collisionMinZigzags {
+			evidence = append(evidence, fmt.Sprintf("%s alternates between two values: %v",
+				sensorMetadata[t].Name, values))
+		}
+	}
+
+	name := collisionAlertName(d.id)
+	if len(evidence) > 0 {
+		sort.Strings(evidence)
+		m.alerts.Raise(name, fmt.Sprintf("Device #%04x may be two devices with the same ID", d.id), evidence...)
+	} else {
+		m.alerts.Clear(name)
+	}
+}
+
+// zigzags counts the steps in a series that jump away and straight back,
+// as seen when two sources take turns
+func zigzags(values []uint16) int {
+	count := 0
+
+	for i := 2; i < len(values); i++ {
+		a, b, c := float64(values[i-2]), float64(values[i-1]), float64(values[i])
+
+		step := math.Abs(b - a)
+		back := math.Abs(c - a)
+		if step > math.Abs(a)/100+1 && back < step/4 {
+			count++
+		}
+	}
+
+	return count
+}
+
+func appendWindow[T any](window []T, v T, size int) []T {
+	window = append(window, v)
+	if len(window) > size {
+		window = window[len(window)-size:]
+	}
+
+	return window
+}
+
+// PrepareReassign checks a device can be moved to a new ID, carrying its
+// registry approval over so the device is admitted once it switches.  The
+// caller queues the change via the downlink; with two devices sharing the
+// old ID, whichever reports first takes the command.
+func (m *DeviceManager) PrepareReassign(id uint16, newID uint16) error {
+	return m.doLocked(func() error {
+		if _, ok := m.devices[id]; !ok {
+			return ErrUnknownDevice
+		}
+
+		if _, ok := m.devices[newID]; ok || newID >= firstZoneID {
+			return ErrDeviceIDInUse
+		}
+
+		if entry, ok := m.registry.Get(id); ok && entry.Status == RegistryApproved {
+			return m.setRegistryStatus(newID, RegistryApproved)
+		}
+
+		return nil
+	})
+}
@@ -3,8 +3,33 @@ package main
 import (
 	"encoding/json"
 	"os"
+	"time"
 )
 
+// Duration is a time.Duration that is written in config files as a
+// string, such as "90s" or "24h"
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(data []byte) error {
+	var s string
+	err := json.Unmarshal(data, &s)
+	if err != nil {
+		return err
+	}
+
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(v)
+	return nil
+}
+
 type MQTTSettings struct {
 	Broker          string `json:"broker"`
 	Port            int    `json:"port"`
@@ -12,10 +37,337 @@ type MQTTSettings struct {
 	Password        string `json:"password"`
 	ClientID        string `json:"clientId"`
 	DiscoveryPrefix string `json:"discoveryPrefix"`
+
+	// Brokers are URLs such as "ssl://broker:8883" or "wss://broker/mqtt",
+	// tried in order so later ones are failovers.  Schemes are tcp, ssl,
+	// ws and wss.  Broker and Port are used if empty.
+	Brokers []string `json:"brokers"`
+
+	TLS MQTTTLSSettings `json:"tls"`
+
+	// Version of MQTT, 3 (for 3.1.1, the default) or 5
+	Version int `json:"version"`
+
+	// SharedGroup, with MQTT 5, shares command subscriptions among a
+	// group of controllers so each command is handled once
+	SharedGroup string `json:"sharedGroup"`
+
+	// StateExpiry, with MQTT 5, drops state messages not delivered in
+	// time rather than delivering them late
+	StateExpiry Duration `json:"stateExpiry"`
+
+	Commands MQTTCommandSettings `json:"commands"`
+}
+
+// MQTTTLSSettings configure connections to ssl:// and wss:// brokers
+type MQTTTLSSettings struct {
+	// CA is a PEM bundle of certificates to trust, the system's if empty
+	CA string `json:"ca"`
+
+	// Cert and Key are PEM files of a client certificate to present
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+
+	// InsecureSkipVerify accepts any broker certificate, for labs only
+	InsecureSkipVerify bool `json:"insecureSkipVerify"`
+}
+
+// MQTTCommandSettings authorize commands received over MQTT, by topic.
+// Nothing is accepted unless allowed.  Commands are "coils",
+// "report_interval", "identify", "rename" and "forget".
+type MQTTCommandSettings struct {
+	// Entities lists the commands given an entity, and command topic, on
+	// each device
+	Entities []string `json:"entities"`
+
+	// Controller lists the commands accepted on the controller command
+	// topic
+	Controller []string `json:"controller"`
+
+	// Devices limits commands to these device IDs, all if empty
+	Devices []uint16 `json:"devices"`
+}
+
+type HistorySettings struct {
+	// Dir holds the time-series store, history is disabled if empty
+	Dir string `json:"dir"`
+
+	// Retention per rollup tier ("1m", "1h" or "1d"), overriding the
+	// defaults.  Zero keeps the tier forever.
+	Retention map[string]Duration `json:"retention"`
+}
+
+// FilterSettings configure one stage of a sensor filter chain.  Values
+// are in base units (°C, Pa, V, %, W).
+type FilterSettings struct {
+	// Type is "range", "rate", "median" or "ema"
+	Type string `json:"type"`
+
+	// Min and/or Max plausible values for a "range" filter
+	Min *float64 `json:"min"`
+	Max *float64 `json:"max"`
+
+	// MaxRate of change per minute for a "rate" filter
+	MaxRate float64 `json:"maxRate"`
+
+	// Window is the number of samples a "median" filter uses
+	Window int `json:"window"`
+
+	// Alpha is the weight of each new sample for an "ema" filter
+	Alpha float64 `json:"alpha"`
+}
+
+// SensorSettings apply to every sensor of one type
+type SensorSettings struct {
+	// MaxAge after which a reading is considered stale
+	MaxAge Duration `json:"maxAge"`
+
+	// Filters applied in order to each (calibrated) sample.  A rejected
+	// sample leaves the previous reading in place.
+	Filters []FilterSettings `json:"filters"`
+}
+
+// DeviceSettings apply to a single device
+type DeviceSettings struct {
+	// Altitude of the device in metres, used to derive sea-level pressure
+	Altitude *float64 `json:"altitude"`
+
+	// Calibration keyed by sensor name, applied before readings are
+	// published
+	Calibration map[string]Calibration `json:"calibration"`
+
+	// BatteryChemistry selects the profile used to estimate battery level,
+	// one of "liion" (default), "lifepo4", "alkaline" or "nimh"
+	BatteryChemistry string `json:"batteryChemistry"`
+}
+
+// ZoneSettings groups devices into a zone with aggregate readings
+type ZoneSettings struct {
+	// ID of the zone's virtual device, allocated from 0xFF00 if not set
+	ID *uint16 `json:"id"`
+
+	// Devices in the zone
+	Devices []uint16 `json:"devices"`
+}
+
+// TimeWindowSettings is a time of day range, "HH:MM" in local time.  The
+// window wraps past midnight if From is after To.
+type TimeWindowSettings struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+}
+
+// ConditionSettings is one node of a rule condition.  Exactly one of
+// All, Any, Not, Above/Below (with Sensor), Alert, Stale or Time is set.
+type ConditionSettings struct {
+	All []ConditionSettings `json:"all"`
+	Any []ConditionSettings `json:"any"`
+	Not *ConditionSettings  `json:"not"`
+
+	// Sensor the reading threshold or staleness applies to
+	Sensor string `json:"sensor"`
+
+	// Above and/or Below are thresholds in output units.  Once true, the
+	// condition stays true until the value passes back by Hysteresis.
+	Above      *float64 `json:"above"`
+	Below      *float64 `json:"below"`
+	Hysteresis float64  `json:"hysteresis"`
+
+	// Alert is a device alert name (eg. "BattLow") or "any"
+	Alert string `json:"alert"`
+
+	// Stale is true if the Sensor reading is stale or missing, or if no
+	// Sensor is given, if the device has gone
+	Stale bool `json:"stale"`
+
+	Time *TimeWindowSettings `json:"time"`
+}
+
+// ActionSettings is something a rule does when raised or cleared.  Text
+// fields may include {rule}, {device} and {event} placeholders.
+type ActionSettings struct {
+	// Type is one of "log", "mqtt", "webhook", "coils" or "alert"
+	Type string `json:"type"`
+
+	// Topic and Payload of an "mqtt" action
+	Topic   string `json:"topic"`
+	Payload string `json:"payload"`
+
+	// URL a "webhook" action POSTs the event to, as JSON
+	URL string `json:"url"`
+
+	// Coils value set by a "coils" action on Device, or the rule's device
+	Coils  *uint16 `json:"coils"`
+	Device *uint16 `json:"device"`
+
+	// Alert is the name of the controller alert raised by an "alert"
+	// action (and cleared with the rule)
+	Alert string `json:"alert"`
+
+	// Message for "log" and "alert" actions
+	Message string `json:"message"`
+}
+
+type RuleSettings struct {
+	Name string `json:"name"`
+
+	// Devices the rule is evaluated for, all devices if empty
+	Devices []uint16 `json:"devices"`
+
+	When ConditionSettings `json:"when"`
+
+	// For is how long the condition must hold before the rule is raised
+	For Duration `json:"for"`
+
+	Actions []ActionSettings `json:"actions"`
+	OnClear []ActionSettings `json:"onClear"`
+
+	// DryRun traces the rule without running actions
+	DryRun bool `json:"dryRun"`
+}
+
+type RulesSettings struct {
+	// DryRun applies to all rules
+	DryRun bool           `json:"dryRun"`
+	Rules  []RuleSettings `json:"rules"`
+}
+
+// APISettings configure the management API
+type APISettings struct {
+	// Listen is the address the API listens on, "localhost:8081" if empty.
+	// The API is unauthenticated, so only listen on other interfaces if
+	// the network is trusted.
+	Listen string `json:"listen"`
+}
+
+// DownlinkSettings configure commands sent to devices
+type DownlinkSettings struct {
+	// ProvisionalKeys sends commands using the controller's provisional
+	// configuration keys, for firmware built to match them.  Commands are
+	// refused otherwise, as the protocol does not define the keys yet.
+	ProvisionalKeys bool `json:"provisionalKeys"`
+}
+
+type OnboardingSettings struct {
+	// Mode is "open" (default) to track any device heard, or "approval"
+	// to hold unknown devices as pending until approved
+	Mode string `json:"mode"`
+
+	// Allow lists devices that are always accepted
+	Allow []uint16 `json:"allow"`
+}
+
+// SensorProfileSettings describe how outputs present one sensor
+type SensorProfileSettings struct {
+	Icon string `json:"icon"`
+
+	// Diagnostic readings are about the device rather than what it
+	// measures
+	Diagnostic *bool `json:"diagnostic"`
+
+	// Precision is the number of decimal places to display
+	Precision *int `json:"precision"`
+
+	// Disabled readings are hidden until enabled, by outputs that support
+	// it, as too noisy to show by default
+	Disabled *bool `json:"disabled"`
+}
+
+type ProfileMatchSettings struct {
+	// Sensors the device must report
+	Sensors []string `json:"sensors"`
+
+	// Versions of firmware, any if empty
+	Versions []uint16 `json:"versions"`
+
+	// Zone matches zones rather than devices
+	Zone bool `json:"zone"`
+}
+
+// ProfileSettings describe a model of device
+type ProfileSettings struct {
+	Name         string               `json:"name"`
+	Match        ProfileMatchSettings `json:"match"`
+	Manufacturer string               `json:"manufacturer"`
+	Model        string               `json:"model"`
+
+	// ExpectedInterval between reports
+	ExpectedInterval Duration `json:"expectedInterval"`
+
+	// Sensors keyed by name, overriding the defaults
+	Sensors map[string]SensorProfileSettings `json:"sensors"`
+}
+
+// DeadbandSettings set how far a reading must move, in base units, before
+// it is published again.  With both set, a change must exceed both.
+type DeadbandSettings struct {
+	Absolute float64 `json:"absolute"`
+
+	// Relative change as a fraction of the last published value
+	Relative float64 `json:"relative"`
+}
+
+// PublishSettings limit how often device updates are published to MQTT
+// and WebSocket clients
+type PublishSettings struct {
+	// MinInterval between updates of a device, zero for no limit
+	MinInterval Duration `json:"minInterval"`
+
+	// MaxInterval after which an unchanged device is published anyway,
+	// zero to only publish changes
+	MaxInterval Duration `json:"maxInterval"`
+
+	// Deadbands keyed by sensor name.  Readings without a deadband are
+	// published on any change, except diagnostic readings which wait for
+	// another change or the heartbeat.
+	Deadbands map[string]DeadbandSettings `json:"deadbands"`
+}
+
+type EventLogSettings struct {
+	// Path of the event log, the log is disabled if empty
+	Path string `json:"path"`
+
+	// MaxSize in bytes before the log is rotated
+	MaxSize int64 `json:"maxSize"`
+
+	// MaxFiles is the number of files kept, including the current one
+	MaxFiles int `json:"maxFiles"`
 }
 
 type Config struct {
-	Mqtt MQTTSettings `json:"mqtt"`
+	Mqtt    MQTTSettings    `json:"mqtt"`
+	History HistorySettings `json:"history"`
+
+	// Sensors holds settings keyed by sensor name, eg. "temperature"
+	Sensors map[string]SensorSettings `json:"sensors"`
+
+	// Devices holds settings keyed by (decimal) device ID
+	Devices map[string]DeviceSettings `json:"devices"`
+
+	// Units selects the output unit by dimension, eg. "temperature": "°F".
+	// Dimensions are "temperature", "pressure", "voltage" and "power".
+	Units map[string]string `json:"units"`
+
+	// Zones keyed by name
+	Zones map[string]ZoneSettings `json:"zones"`
+
+	Rules RulesSettings `json:"rules"`
+
+	// Registry is the file that device approvals are stored in
+	Registry string `json:"registry"`
+
+	Onboarding OnboardingSettings `json:"onboarding"`
+
+	Events EventLogSettings `json:"events"`
+
+	Publish PublishSettings `json:"publish"`
+
+	Downlink DownlinkSettings `json:"downlink"`
+
+	API APISettings `json:"api"`
+
+	// Profiles are matched in order before the built-in profiles
+	Profiles []ProfileSettings `json:"profiles"`
 }
 
 func LoadConfig() (*Config, error) {
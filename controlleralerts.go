@@ -0,0 +1,86 @@
+package main
+
+import (
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// ControllerAlert is a problem detected by the controller itself, rather
+// than reported by a device
+type ControllerAlert struct {
+	Name     string
+	Message  string
+	Raised   time.Time
+	Evidence []string `json:",omitempty"`
+}
+
+// ControllerAlerts tracks the active controller alerts by name
+type ControllerAlerts struct {
+	lock   sync.Mutex
+	active map[string]ControllerAlert
+	events *EventLog
+}
+
+func NewControllerAlerts(events *EventLog) *ControllerAlerts {
+	return &ControllerAlerts{
+		active: map[string]ControllerAlert{},
+		events: events,
+	}
+}
+
+// Raise activates (or updates) an alert, returning true if it was not
+// already active
+func (a *ControllerAlerts) Raise(name string, message string, evidence ...string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	existing, ok := a.active[name]
+	raised := time.Now()
+	if ok {
+		raised = existing.Raised
+	} else {
+		log.Printf("Alert raised: %s: %s", name, message)
+		a.events.Record(Event{Type: EventAlertRaised, Message: message,
+			Data: map[string]any{"alert": name, "evidence": evidence}})
+	}
+
+	a.active[name] = ControllerAlert{
+		Name:     name,
+		Message:  message,
+		Raised:   raised,
+		Evidence: evidence,
+	}
+
+	return !ok
+}
+
+// Clear deactivates an alert, returning true if it was active
+func (a *ControllerAlerts) Clear(name string) bool {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	_, ok := a.active[name]
+	if ok {
+		log.Printf("Alert cleared: %s", name)
+		delete(a.active, name)
+		a.events.Record(Event{Type: EventAlertCleared, Data: map[string]any{"alert": name}})
+	}
+
+	return ok
+}
+
+// Active lists the active alerts, oldest first
+func (a *ControllerAlerts) Active() []ControllerAlert {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+
+	result := make([]ControllerAlert, 0, len(a.active))
+	for _, v := range a.active {
+		result = append(result, v)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Raised.Before(result[j].Raised) })
+
+	return result
+}
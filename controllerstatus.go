@@ -0,0 +1,81 @@
+package main
+
+import (
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// Version of the controller, set when building with
+// -ldflags "-X main.Version=..." or taken from the module version
+var Version = ""
+
+func controllerVersion() string {
+	if Version != "" {
+		return Version
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+		return info.Main.Version
+	}
+
+	return "unknown"
+}
+
+// ControllerStatus tracks the health of the controller itself
+type ControllerStatus struct {
+	lock           sync.Mutex
+	started        time.Time
+	radioConnected bool
+	received       []time.Time
+}
+
+func NewControllerStatus() *ControllerStatus {
+	return &ControllerStatus{started: time.Now()}
+}
+
+// SetRadioConnected records whether the radio dongle is connected
+func (s *ControllerStatus) SetRadioConnected(connected bool) {
+	s.lock.Lock()
+	s.radioConnected = connected
+	s.lock.Unlock()
+}
+
+// Received counts a packet received by the radio, valid or not
+func (s *ControllerStatus) Received(now time.Time) {
+	s.lock.Lock()
+	s.received = append(s.pruneReceived(now), now)
+	s.lock.Unlock()
+}
+
+// pruneReceived drops packets received over a minute ago.  Must be called
+// with the lock held.
+func (s *ControllerStatus) pruneReceived(now time.Time) []time.Time {
+	i := 0
+	for i < len(s.received) && now.Sub(s.received[i]) > time.Minute {
+		i++
+	}
+
+	return append(s.received[:0], s.received[i:]...)
+}
+
+// Uptime gets how long the controller has been running
+func (s *ControllerStatus) Uptime(now time.Time) time.Duration {
+	return now.Sub(s.started)
+}
+
+func (s *ControllerStatus) RadioConnected() bool {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.radioConnected
+}
+
+// PacketsPerMinute gets the number of packets received in the last minute
+func (s *ControllerStatus) PacketsPerMinute(now time.Time) int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.received = s.pruneReceived(now)
+	return len(s.received)
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"math"
+
+	"github.com/netleapio/zappy-framework/protocol"
+)
+
+// DerivedSensor computes a virtual reading from other readings of the
+// same device.
+//
+// To add a derived quantity, allocate it a sensor type and add an
+// implementation to derivedSensors.  Derived readings are published by
+// every listener exactly like readings sent by devices.
+type DerivedSensor interface {
+	// Type is the sensor type of the derived reading
+	Type() protocol.SensorType
+
+	// Info describes the derived reading, values are always in SI units
+	Info() *protocol.SensorInfo
+
+	// Inputs lists the readings needed to derive a value
+	Inputs() []protocol.SensorType
+
+	// Derive computes the value from the inputs (in SI units), returning
+	// false if no value can be derived
+	Derive(inputs map[protocol.SensorType]float64, settings *DeviceSettings) (float64, bool)
+}
+
+// derivedSensors are evaluated in order, so may use earlier derived
+// readings as inputs
+var derivedSensors = []DerivedSensor{
+	dewPoint{},
+	absoluteHumidity{},
+	heatIndex{},
+	seaLevelPressure{},
+}
+
+// Magnus formula coefficients (Alduchov & Eskridge) over water
+const (
+	magnusA = 6.112
+	magnusB = 17.62
+	magnusC = 243.12
+)
+
+type dewPoint struct{}
+
+func (dewPoint) Type() protocol.SensorType { return SensorTypeDewPoint }
+
+func (dewPoint) Info() *protocol.SensorInfo {
+	return &protocol.SensorInfo{Name: "dewpoint", Unit: "celsius", Mult: 1, Div: 1}
+}
+
+func (dewPoint) Inputs() []protocol.SensorType {
+	return []protocol.SensorType{protocol.SensorTypeTemperature, protocol.SensorTypeHumidity}
+}
+
+func (dewPoint) Derive(inputs map[protocol.SensorType]float64, settings *DeviceSettings) (float64, bool) {
+	t := inputs[protocol.SensorTypeTemperature]
+	rh := inputs[protocol.SensorTypeHumidity]
+	if rh <= 0 {
+		return 0, false
+	}
+
+	gamma := math.Log(rh/100) + magnusB*t/(magnusC+t)
+	return magnusC * gamma / (magnusB - gamma), true
+}
+
+type absoluteHumidity struct{}
+
+func (absoluteHumidity) Type() protocol.SensorType { return SensorTypeAbsoluteHumidity }
+
+func (absoluteHumidity) Info() *protocol.SensorInfo {
+	return &protocol.SensorInfo{Name: "absolute_humidity", Unit: "grams_per_cubic_metre", Mult: 1, Div: 1}
+}
+
+func (absoluteHumidity) Inputs() []protocol.SensorType {
+	return []protocol.SensorType{protocol.SensorTypeTemperature, protocol.SensorTypeHumidity}
+}
+
+func (absoluteHumidity) Derive(inputs map[protocol.SensorType]float64, settings *DeviceSettings) (float64, bool) {
+	t := inputs[protocol.SensorTypeTemperature]
+	rh := inputs[protocol.SensorTypeHumidity]
+
+	// Saturation vapour pressure (hPa) scaled by RH, converted to g/m³
+	// using the ideal gas law for water vapour
+	vp := magnusA * math.Exp(magnusB*t/(magnusC+t)) * rh / 100
+	return vp * 100 * 18.01528 / (8.31446 * (t + 273.15)), true
+}
+
+type heatIndex struct{}
+
+func (heatIndex) Type() protocol.SensorType { return SensorTypeHeatIndex }
+
+func (heatIndex) Info() *protocol.SensorInfo {
+	return &protocol.SensorInfo{Name: "heat_index", Unit: "celsius", Mult: 1, Div: 1}
+}
+
+func (heatIndex) Inputs() []protocol.SensorType {
+	return []protocol.SensorType{protocol.SensorTypeTemperature, protocol.SensorTypeHumidity}
+}
+
+// Derive uses the NOAA heat index algorithm, which works in Fahrenheit
+func (heatIndex) Derive(inputs map[protocol.SensorType]float64, settings *DeviceSettings) (float64, bool) {
+	t := inputs[protocol.SensorTypeTemperature]*9/5 + 32
+	rh := inputs[protocol.SensorTypeHumidity]
+
+	hi := 0.5 * (t + 61.0 + (t-68.0)*1.2 + rh*0.094)
+
+	if (hi+t)/2 >= 80 {
+		hi = -42.379 + 2.04901523*t + 10.14333127*rh -
+			0.22475541*t*rh - 0.00683783*t*t - 0.05481717*rh*rh +
+			0.00122874*t*t*rh + 0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+
+		if rh < 13 && t >= 80 && t <= 112 {
+			hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+		} else if rh > 85 && t >= 80 && t <= 87 {
+			hi += (rh - 85) / 10 * (87 - t) / 5
+		}
+	}
+
+	return (hi - 32) * 5 / 9, true
+}
+
+type seaLevelPressure struct{}
+
+func (seaLevelPressure) Type() protocol.SensorType { return SensorTypeSeaLevelPressure }
+
+func (seaLevelPressure) Info() *protocol.SensorInfo {
+	return &protocol.SensorInfo{Name: "sealevel_pressure", Unit: "pascals", Mult: 1, Div: 1}
+}
+
+func (seaLevelPressure) Inputs() []protocol.SensorType {
+	return []protocol.SensorType{protocol.SensorTypePressure, protocol.SensorTypeTemperature}
+}
+
+// Derive uses the hypsometric formula, so needs the device altitude
+func (seaLevelPressure) Derive(inputs map[protocol.SensorType]float64, settings *DeviceSettings) (float64, bool) {
+	if settings.Altitude == nil {
+		return 0, false
+	}
+
+	p := inputs[protocol.SensorTypePressure]
+	t := inputs[protocol.SensorTypeTemperature]
+	h := *settings.Altitude
+
+	return p * math.Pow(1-0.0065*h/(t+0.0065*h+273.15), -5.257), true
+}
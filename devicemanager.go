@@ -1,7 +1,10 @@
 package main
 
 import (
+	"fmt"
 	"log"
+	"math"
+	"strconv"
 	"sync"
 	"time"
 
@@ -11,6 +14,12 @@ import (
 const (
 	// Constant for now - may be adaptable in future
 	DeviceUpdatePeriod = 1 * time.Minute
+
+	// DefaultReadingMaxAge applies to sensor types without a configured
+	// max age
+	DefaultReadingMaxAge = 2 * DeviceUpdatePeriod
+
+	staleCheckPeriod = 10 * time.Second
 )
 
 type DeviceChangeTypes int
@@ -20,6 +29,9 @@ const (
 	ChangeNewDevice                   = 1 << iota
 	ChangeDeviceUpdate
 	ChangeDeviceGone
+	ChangeReadingsStale
+	ChangeDevicePending
+	ChangeDeviceRemoved
 )
 
 type DeviceChange struct {
@@ -33,44 +45,268 @@ type DeviceChange struct {
 // considered unique.
 //
 // DeviceManager will stop tracking devices that have not been seen for
-// three update periods.
+// three update periods.  Such devices may come back, whereas a device that
+// is forgotten is removed for good.
+//
+// Readings that have not been refreshed within the max age of their sensor
+// type are marked stale.
+//
+// Zones are tracked as virtual devices whose readings aggregate those of
+// their members.
 type DeviceManager struct {
-	lock      sync.Mutex
-	devices   map[uint16]*DeviceState
-	listeners []chan DeviceChange
+	lock       sync.Mutex
+	devices    map[uint16]*DeviceState
+	listeners  []chan DeviceChange
+	maxAge     map[protocol.SensorType]time.Duration
+	filters    map[protocol.SensorType][]readingFilter
+	settings   map[uint16]*DeviceSettings
+	units      *Units
+	zones      map[string]*zone
+	alerts     *ControllerAlerts
+	batteries  map[uint16]*batteryState
+	registry   *Registry
+	onboarding *onboarding
+
+	traffic        map[uint16]*trafficState
+	decodeFailures uint64
+
+	events   *EventLog
+	profiles []*DeviceProfile
+	status   *ControllerStatus
 }
 
 type DeviceState struct {
 	id       uint16
 	lastSeen time.Time
 	alerts   protocol.Alerts
-	sensors  map[protocol.SensorType]uint16
+	sensors  map[protocol.SensorType]Reading
+
+	// filters holds the filter chain state of each sensor type, and
+	// rejected counts the samples the chains have rejected
+	filters  map[protocol.SensorType][]filterState
+	rejected map[protocol.SensorType]uint64
+
+	collision *collisionState
+
+	// zone is the name of the zone for virtual zone devices
+	zone string
+}
+
+// Reading is the latest value of one sensor on a device
+type Reading struct {
+	// Value in SI units
+	Value float64
+
+	// Raw value as sent by the device, zero for derived readings
+	Raw uint16
+
+	// Unfiltered is the calibrated value before filtering
+	Unfiltered float64
+
+	// Received is when the packet holding the reading arrived
+	Received time.Time
+
+	// Packet is a copy of the raw packet the reading arrived in
+	Packet []byte
+
+	// Stale indicates the reading is older than the max age for its type
+	Stale bool
 }
 
-func NewDeviceManager() *DeviceManager {
-	return &DeviceManager{
-		lock:      sync.Mutex{},
-		devices:   make(map[uint16]*DeviceState),
-		listeners: make([]chan DeviceChange, 0),
+// reading gets a reading, handling devices that have gone (nil)
+func (d *DeviceState) reading(t protocol.SensorType) (Reading, bool) {
+	if d == nil {
+		return Reading{}, false
 	}
+
+	r, ok := d.sensors[t]
+	return r, ok
+}
+
+func NewDeviceManager(cfg *Config) (*DeviceManager, error) {
+	units, err := NewUnits(cfg.Units)
+	if err != nil {
+		return nil, err
+	}
+
+	onboarding, err := newOnboarding(&cfg.Onboarding)
+	if err != nil {
+		return nil, err
+	}
+
+	profiles, err := loadProfiles(cfg.Profiles)
+	if err != nil {
+		return nil, err
+	}
+
+	var events *EventLog
+	if cfg.Events.Path != "" {
+		events, err = OpenEventLog(&cfg.Events)
+		if err != nil {
+			return nil, fmt.Errorf("error opening event log: %w", err)
+		}
+	}
+
+	registryPath := cfg.Registry
+	if registryPath == "" {
+		registryPath = DefaultRegistryPath
+	}
+
+	registry, err := OpenRegistry(registryPath, events)
+	if err != nil {
+		return nil, fmt.Errorf("error loading registry: %w", err)
+	}
+
+	m := &DeviceManager{
+		lock:       sync.Mutex{},
+		devices:    make(map[uint16]*DeviceState),
+		listeners:  make([]chan DeviceChange, 0),
+		maxAge:     make(map[protocol.SensorType]time.Duration),
+		filters:    make(map[protocol.SensorType][]readingFilter),
+		settings:   make(map[uint16]*DeviceSettings),
+		units:      units,
+		zones:      make(map[string]*zone),
+		alerts:     NewControllerAlerts(events),
+		batteries:  make(map[uint16]*batteryState),
+		registry:   registry,
+		onboarding: onboarding,
+		traffic:    make(map[uint16]*trafficState),
+		events:     events,
+		profiles:   profiles,
+		status:     NewControllerStatus(),
+	}
+
+	for name, s := range cfg.Sensors {
+		t, ok := sensorTypeByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown sensor type '%s'", name)
+		}
+
+		if s.MaxAge != 0 {
+			m.maxAge[t] = time.Duration(s.MaxAge)
+		}
+
+		for _, fs := range s.Filters {
+			f, err := compileFilter(&fs)
+			if err != nil {
+				return nil, fmt.Errorf("sensor '%s': %w", name, err)
+			}
+			m.filters[t] = append(m.filters[t], f)
+		}
+	}
+
+	for idStr, s := range cfg.Devices {
+		id, err := strconv.ParseUint(idStr, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid device id '%s'", idStr)
+		}
+
+		for name := range s.Calibration {
+			_, ok := sensorTypeByName(name)
+			if !ok {
+				return nil, fmt.Errorf("device %d: unknown sensor type '%s'", id, name)
+			}
+		}
+
+		if _, ok := batteryProfiles[batteryChemistry(&s)]; !ok {
+			return nil, fmt.Errorf("device %d: unknown battery chemistry '%s', expected one of %v",
+				id, s.BatteryChemistry, batteryChemistries())
+		}
+
+		s := s
+		m.settings[uint16(id)] = &s
+	}
+
+	err = m.initZones(cfg.Zones)
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
 }
 
 func (m *DeviceManager) Start() {
 	go m.cleanupDevices()
+	go m.checkStaleness()
 }
 
 func (m *DeviceManager) DeviceSensorUpdate(rpt *protocol.SensorReport) {
 	changes := ChangeNone
 
+	admitted := false
+	m.doLocked(func() error {
+		admitted = m.admit(rpt.Packet().DeviceID(), time.Now())
+		return nil
+	})
+	if !admitted {
+		return
+	}
+
 	d := m.getOrCreate(&changes, rpt.Packet().DeviceID())
+	if d.zone != "" {
+		log.Printf("Device #%04x clashes with zone '%s', ignoring", d.id, d.zone)
+		return
+	}
+
+	duplicate := false
+	m.doLocked(func() error {
+		now := time.Now()
+		src := append([]byte(nil), rpt.Packet().AsBytes()...)
+
+		if !m.updateTraffic(d, rpt.Packet(), now) {
+			duplicate = true
+			return nil
+		}
+
+		d.lastSeen = now
+		m.recordAlertChanges(d.id, d.alerts, rpt.Packet().Alerts())
+		d.alerts = rpt.Packet().Alerts()
+
+		m.detectCollision(d, rpt, now)
+
+		accepted := map[string]any{}
+
+		// Add to existing sensor readings in case device sends an incomplete
+		// set of readings
+		for k, v := range rpt.AllReadings() {
+			md := sensorMetadata[k]
+			if md == nil {
+				continue
+			}
+
+			unfiltered := m.calibrate(d.id, md, sensorValue(md, v))
+
+			value, ok := m.filter(d, k, unfiltered, now)
+			if !ok {
+				log.Printf("Device #%04x: rejected %s sample %v", d.id, md.Name, unfiltered)
+				m.events.Record(deviceEvent(d.id, EventReadingRejected, "",
+					map[string]any{"sensor": md.Name, "value": unfiltered}))
+				continue
+			}
+			accepted[md.Name] = value
+
+			d.sensors[k] = Reading{
+				Value:      value,
+				Raw:        v,
+				Unfiltered: unfiltered,
+				Received:   now,
+				Packet:     src,
+			}
+		}
+
+		if len(accepted) > 0 {
+			m.events.Record(deviceEvent(d.id, EventReadingAccepted, "", accepted))
+		}
 
-	d.lastSeen = time.Now()
-	d.alerts = rpt.Packet().Alerts()
+		m.updateBattery(d, now)
+		m.deriveReadings(d, now)
+		m.updateZonesFor(d.id, now)
 
-	// Add to existing sensor readings in case device sends an incomplete
-	// set of readings
-	for k, v := range rpt.AllReadings() {
-		d.sensors[k] = v
+		return nil
+	})
+	if duplicate {
+		log.Printf("Device #%04x: duplicate packet, ignoring", d.id)
+		return
 	}
 
 	changes |= ChangeDeviceUpdate
@@ -78,26 +314,171 @@ func (m *DeviceManager) DeviceSensorUpdate(rpt *protocol.SensorReport) {
 	m.notifyListeners(rpt.Packet().DeviceID(), changes)
 }
 
-func (m *DeviceManager) GetDevice(id uint16) *DeviceState {
-	return m.get(id)
+// Forget removes all trace of a device that has been decommissioned,
+// including its registry entry.  Listeners are told it was removed rather
+// than that it has gone.
+func (m *DeviceManager) Forget(id uint16) error {
+	return m.doLocked(func() error {
+		d, tracked := m.devices[id]
+		if tracked && d.zone != "" {
+			return ErrUnknownDevice
+		}
+
+		_, seen := m.traffic[id]
+		_, registered := m.registry.Get(id)
+		if !tracked && !seen && !registered {
+			return ErrUnknownDevice
+		}
+
+		log.Printf("Device #%04x: forgotten", id)
+		m.events.Record(deviceEvent(id, EventDeviceRemoved, "", nil))
+
+		delete(m.devices, id)
+		delete(m.batteries, id)
+		delete(m.traffic, id)
+		delete(m.onboarding.pending, id)
+		delete(m.onboarding.rejected, id)
+		m.alerts.Clear(collisionAlertName(id))
+
+		if registered {
+			err := m.registry.Delete(id)
+			if err != nil {
+				return err
+			}
+		}
+
+		m.notifyListeners(id, DeviceChangeTypes(ChangeDeviceGone|ChangeDeviceRemoved))
+		m.updateZonesFor(id, time.Now())
+		return nil
+	})
 }
 
-func (m *DeviceManager) AddListener(ch chan DeviceChange) {
-	m.listeners = append(m.listeners, ch)
+// Rename sets the name a device is shown with, saved in the registry
+func (m *DeviceManager) Rename(id uint16, name string) error {
+	return m.doLocked(func() error {
+		d, tracked := m.devices[id]
+		_, registered := m.registry.Get(id)
+		if (tracked && d.zone != "") || (!tracked && !registered) {
+			return ErrUnknownDevice
+		}
+
+		entry, _ := m.registry.Get(id)
+		entry.ID = id
+		entry.Name = name
+
+		return m.registry.Set(entry)
+	})
 }
 
-func (m *DeviceManager) get(id uint16) *DeviceState {
-	var device *DeviceState
+// DeviceName gets the name of a device as renamed, or else from its
+// profile.  Empty if the device is unknown.
+func (m *DeviceManager) DeviceName(id uint16) string {
+	result := ""
+
+	m.doLocked(func() error {
+		if d, ok := m.devices[id]; ok {
+			result = m.nameOf(d)
+		}
+		return nil
+	})
+
+	return result
+}
+
+// nameOf gets the name of a device.  Must be called with the lock held.
+func (m *DeviceManager) nameOf(d *DeviceState) string {
+	if entry, ok := m.registry.Get(d.id); ok && entry.Name != "" && d.zone == "" {
+		return entry.Name
+	}
+
+	return m.profileFor(d).DisplayName(d)
+}
+
+// recordAlertChanges logs the alerts a device has raised or cleared
+func (m *DeviceManager) recordAlertChanges(id uint16, prev protocol.Alerts, alerts protocol.Alerts) {
+	if raised := alerts &^ prev; raised != protocol.AlertNone {
+		m.events.Record(deviceEvent(id, EventAlertRaised, "", map[string]any{"alerts": raised.Strings()}))
+	}
+	if cleared := prev &^ alerts; cleared != protocol.AlertNone {
+		m.events.Record(deviceEvent(id, EventAlertCleared, "", map[string]any{"alerts": cleared.Strings()}))
+	}
+}
+
+// Events gets the event log, which is nil if disabled
+func (m *DeviceManager) Events() *EventLog {
+	return m.events
+}
+
+// Controller gets the health of the controller itself
+func (m *DeviceManager) Controller() *ControllerStatus {
+	return m.status
+}
+
+// Registry gets the persistent store of known devices
+func (m *DeviceManager) Registry() *Registry {
+	return m.registry
+}
+
+// ControllerAlerts gets the alerts raised by the controller itself
+func (m *DeviceManager) ControllerAlerts() *ControllerAlerts {
+	return m.alerts
+}
+
+// Snapshot gets a copy of a device's state that is safe to use without
+// holding the lock, or nil if the device is unknown
+func (m *DeviceManager) Snapshot(id uint16) *DeviceState {
+	var result *DeviceState
 
 	m.doLocked(func() error {
 		d, ok := m.devices[id]
-		if ok {
-			device = d
+		if !ok {
+			return nil
+		}
+
+		copy := *d
+		copy.sensors = make(map[protocol.SensorType]Reading, len(d.sensors))
+		for t, r := range d.sensors {
+			copy.sensors[t] = r
 		}
+		result = &copy
+
 		return nil
 	})
 
-	return device
+	return result
+}
+
+// DeviceIDs lists the IDs of all tracked devices
+func (m *DeviceManager) DeviceIDs() []uint16 {
+	result := []uint16{}
+
+	m.doLocked(func() error {
+		for id := range m.devices {
+			result = append(result, id)
+		}
+		return nil
+	})
+
+	return result
+}
+
+// Units gets the conversion of readings to output units
+func (m *DeviceManager) Units() *Units {
+	return m.units
+}
+
+// VisitDevices calls fn for each device while holding the manager lock
+func (m *DeviceManager) VisitDevices(fn func(d *DeviceState)) {
+	m.doLocked(func() error {
+		for _, d := range m.devices {
+			fn(d)
+		}
+		return nil
+	})
+}
+
+func (m *DeviceManager) AddListener(ch chan DeviceChange) {
+	m.listeners = append(m.listeners, ch)
 }
 
 func (m *DeviceManager) getOrCreate(changes *DeviceChangeTypes, id uint16) *DeviceState {
@@ -107,9 +488,14 @@ func (m *DeviceManager) getOrCreate(changes *DeviceChangeTypes, id uint16) *Devi
 		d, ok := m.devices[id]
 		if !ok {
 			*changes |= ChangeNewDevice
+			m.events.Record(deviceEvent(id, EventDeviceDiscovered, "", nil))
 			d = &DeviceState{
-				id:      id,
-				sensors: map[protocol.SensorType]uint16{},
+				id:       id,
+				sensors:  map[protocol.SensorType]Reading{},
+				filters:  map[protocol.SensorType][]filterState{},
+				rejected: map[protocol.SensorType]uint64{},
+
+				collision: newCollisionState(),
 			}
 			m.devices[id] = d
 		}
@@ -128,15 +514,54 @@ func (m *DeviceManager) cleanupDevices() {
 			toRemove := []*DeviceState{}
 
 			for _, d := range m.devices {
-				if now.Sub(d.lastSeen) > 2*DeviceUpdatePeriod {
+				if d.zone == "" && now.Sub(d.lastSeen) > 2*DeviceUpdatePeriod {
 					toRemove = append(toRemove, d)
 				}
 			}
 
 			for _, d := range toRemove {
 				log.Printf("Device #%04x timed-out", d.id)
+				m.events.Record(deviceEvent(d.id, EventDeviceTimeout, "", nil))
 				delete(m.devices, d.id)
+				m.alerts.Clear(collisionAlertName(d.id))
 				m.notifyListeners(d.id, ChangeDeviceGone)
+				m.updateZonesFor(d.id, now)
+			}
+
+			return nil
+		})
+	}
+}
+
+// checkStaleness marks readings stale once they exceed the max age for
+// their sensor type, notifying listeners of affected devices
+func (m *DeviceManager) checkStaleness() {
+	for {
+		time.Sleep(staleCheckPeriod)
+		now := time.Now()
+		m.doLocked(func() error {
+			for _, d := range m.devices {
+				// Zone readings are updated with their members
+				if d.zone != "" {
+					continue
+				}
+
+				changed := false
+
+				// Readings are only fresh again when replaced, as some
+				// are marked stale early
+				for t, r := range d.sensors {
+					if !r.Stale && now.Sub(r.Received) > m.readingMaxAge(t) {
+						r.Stale = true
+						d.sensors[t] = r
+						changed = true
+					}
+				}
+
+				if changed {
+					m.notifyListeners(d.id, ChangeReadingsStale)
+					m.updateZonesFor(d.id, now)
+				}
 			}
 
 			return nil
@@ -144,6 +569,53 @@ func (m *DeviceManager) cleanupDevices() {
 	}
 }
 
+// deriveReadings updates the derived readings of a device whose inputs
+// are all present and fresh
+func (m *DeviceManager) deriveReadings(d *DeviceState, now time.Time) {
+	settings := m.deviceSettings(d.id)
+
+	for _, ds := range derivedSensors {
+		inputs := map[protocol.SensorType]float64{}
+		for _, t := range ds.Inputs() {
+			r, ok := d.sensors[t]
+			if !ok || r.Stale {
+				break
+			}
+			inputs[t] = r.Value
+		}
+
+		if len(inputs) != len(ds.Inputs()) {
+			continue
+		}
+
+		v, ok := ds.Derive(inputs, settings)
+		if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+			continue
+		}
+
+		d.sensors[ds.Type()] = Reading{Value: v, Received: now}
+	}
+}
+
+// deviceSettings gets the configured settings of a device, or defaults
+func (m *DeviceManager) deviceSettings(id uint16) *DeviceSettings {
+	s, ok := m.settings[id]
+	if !ok {
+		return &DeviceSettings{}
+	}
+
+	return s
+}
+
+func (m *DeviceManager) readingMaxAge(t protocol.SensorType) time.Duration {
+	d, ok := m.maxAge[t]
+	if !ok {
+		return DefaultReadingMaxAge
+	}
+
+	return d
+}
+
 func (m *DeviceManager) notifyListeners(id uint16, changes DeviceChangeTypes) {
 	notification := DeviceChange{DeviceID: id, Changes: changes}
 
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/netleapio/zappy-framework/protocol"
+)
+
+// ConfigKey identifies a setting in a configure-device packet.
+//
+// Configure-device packets carry key/value pairs in the same layout as
+// the readings of a sensor report.
+//
+// PROVISIONAL: the protocol (zappy-framework v0.1.1) defines the
+// configure-device packet type but not its keys, so these values are the
+// controller's own and no firmware understands them yet.  Commands are
+// refused unless DownlinkSettings.ProvisionalKeys is set, and the keys
+// should be replaced with the protocol's once it defines them.
+type ConfigKey uint16
+
+const (
+	ConfigCoils ConfigKey = iota + 1
+	ConfigReportInterval
+	ConfigIdentify
+	ConfigDeviceID
+)
+
+func (k ConfigKey) String() string {
+	switch k {
+	case ConfigCoils:
+		return "coils"
+	case ConfigReportInterval:
+		return "report-interval"
+	case ConfigIdentify:
+		return "identify"
+	case ConfigDeviceID:
+		return "device-id"
+	}
+
+	return "unknown"
+}
+
+var ErrDownlinkDisabled = errors.New("downlink commands are disabled until device firmware defines configuration keys")
+
+// DownlinkCommand is a setting to send to a device
+type DownlinkCommand struct {
+	DeviceID uint16
+	Key      ConfigKey
+	Value    uint16
+	Queued   time.Time
+}
+
+// Downlink queues commands for devices.
+//
+// Devices only listen briefly after sending a report, so commands are
+// held until the next report from the device arrives.
+type Downlink struct {
+	lock    sync.Mutex
+	network uint16
+	enabled bool
+	pending map[uint16][]DownlinkCommand
+	events  *EventLog
+}
+
+func NewDownlink(network uint16, cfg *DownlinkSettings, events *EventLog) *Downlink {
+	if cfg.ProvisionalKeys {
+		log.Printf("Downlink: sending commands with provisional configuration keys")
+	}
+
+	return &Downlink{
+		network: network,
+		enabled: cfg.ProvisionalKeys,
+		pending: map[uint16][]DownlinkCommand{},
+		events:  events,
+	}
+}
+
+// Enabled checks whether commands can be sent to devices
+func (q *Downlink) Enabled() bool {
+	return q.enabled
+}
+
+// Queue adds a command, replacing any pending command for the same
+// setting on the device
+func (q *Downlink) Queue(id uint16, key ConfigKey, value uint16) error {
+	if !q.enabled {
+		return ErrDownlinkDisabled
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	cmd := DownlinkCommand{DeviceID: id, Key: key, Value: value, Queued: time.Now()}
+
+	q.events.Record(deviceEvent(id, EventCommandQueued, "",
+		map[string]any{"key": key.String(), "value": value}))
+
+	cmds := q.pending[id]
+	for i, c := range cmds {
+		if c.Key == key {
+			cmds[i] = cmd
+			return nil
+		}
+	}
+
+	q.pending[id] = append(cmds, cmd)
+	log.Printf("Device #%04x: queued %s=%d", id, key, value)
+
+	return nil
+}
+
+// Pending gets the commands waiting for a device
+func (q *Downlink) Pending(id uint16) []DownlinkCommand {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return append([]DownlinkCommand(nil), q.pending[id]...)
+}
+
+// Take removes the pending commands of a device, encoding them into a
+// configure-device packet.  Returns false if nothing is pending.
+func (q *Downlink) Take(id uint16, pkt *protocol.Packet) ([]DownlinkCommand, bool) {
+	q.lock.Lock()
+	cmds := q.pending[id]
+	delete(q.pending, id)
+	q.lock.Unlock()
+
+	if len(cmds) == 0 {
+		return nil, false
+	}
+
+	pkt.Reset()
+	pkt.SetNetworkID(q.network)
+	pkt.SetDeviceID(id)
+	pkt.SetAlerts(protocol.AlertNone)
+	pkt.SetType(protocol.TypeConfigureDevice)
+
+	for _, c := range cmds {
+		pkt.WriteUint16(uint16(c.Key))
+		pkt.WriteUint16(c.Value)
+	}
+
+	pkt.UpdateCRC()
+
+	return cmds, true
+}
+
+// Sent records the outcome of sending commands taken from the queue,
+// putting them back if sending failed
+func (q *Downlink) Sent(id uint16, cmds []DownlinkCommand, err error) {
+	data := map[string]any{}
+	for _, c := range cmds {
+		data[c.Key.String()] = c.Value
+	}
+
+	if err != nil {
+		log.Printf("Device #%04x: failed to send commands: %v", id, err)
+		q.events.Record(deviceEvent(id, EventCommandFailed, err.Error(), data))
+		q.requeue(id, cmds)
+		return
+	}
+
+	log.Printf("Device #%04x: sent %d command(s)", id, len(cmds))
+	q.events.Record(deviceEvent(id, EventCommandSent, "", data))
+}
+
+// requeue puts back commands that failed to send, unless a newer command
+// for the same setting was queued meanwhile
+func (q *Downlink) requeue(id uint16, cmds []DownlinkCommand) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	pending := q.pending[id]
+	for _, c := range cmds {
+		if !hasConfigKey(pending, c.Key) {
+			pending = append(pending, c)
+		}
+	}
+
+	if len(pending) > 0 {
+		q.pending[id] = pending
+	}
+}
+
+func hasConfigKey(cmds []DownlinkCommand, key ConfigKey) bool {
+	for _, c := range cmds {
+		if c.Key == key {
+			return true
+		}
+	}
+
+	return false
+}
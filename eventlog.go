@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultEventLogMaxSize  = 10 * 1024 * 1024
+	DefaultEventLogMaxFiles = 5
+)
+
+// Event types
+const (
+	EventDeviceDiscovered = "device-discovered"
+	EventDevicePending    = "device-pending"
+	EventDeviceTimeout    = "device-timeout"
+	EventDeviceRemoved    = "device-removed"
+	EventReadingAccepted  = "reading-accepted"
+	EventReadingRejected  = "reading-rejected"
+	EventAlertRaised      = "alert-raised"
+	EventAlertCleared     = "alert-cleared"
+	EventCommandQueued    = "command-queued"
+	EventCommandSent      = "command-sent"
+	EventCommandFailed    = "command-failed"
+	EventRegistryUpdated  = "registry-updated"
+	EventRegistryDeleted  = "registry-deleted"
+)
+
+// Event is one entry in the event log
+type Event struct {
+	Time    time.Time
+	Type    string
+	Device  *uint16        `json:",omitempty"`
+	Message string         `json:",omitempty"`
+	Data    map[string]any `json:",omitempty"`
+}
+
+// deviceEvent creates an event about a device
+func deviceEvent(id uint16, eventType string, message string, data map[string]any) Event {
+	return Event{Type: eventType, Device: &id, Message: message, Data: data}
+}
+
+// EventQuery selects events from the log, zero fields match everything
+type EventQuery struct {
+	Device *uint16
+	Type   string
+	Since  time.Time
+	Until  time.Time
+
+	// Limit to the most recent matching events
+	Limit int
+}
+
+func (q *EventQuery) matches(e *Event) bool {
+	switch {
+	case q.Device != nil && (e.Device == nil || *e.Device != *q.Device):
+		return false
+	case q.Type != "" && e.Type != q.Type:
+		return false
+	case !q.Since.IsZero() && e.Time.Before(q.Since):
+		return false
+	case !q.Until.IsZero() && e.Time.After(q.Until):
+		return false
+	}
+
+	return true
+}
+
+// EventLog appends events to a JSONL file, rotating it once it reaches a
+// maximum size and keeping a number of older files as path.1, path.2...
+//
+// A nil EventLog discards events, so the log can be disabled.
+type EventLog struct {
+	lock        sync.Mutex
+	path        string
+	maxSize     int64
+	maxFiles    int
+	file        *os.File
+	size        int64
+	subscribers map[chan Event]bool
+}
+
+func OpenEventLog(cfg *EventLogSettings) (*EventLog, error) {
+	l := &EventLog{
+		path:        cfg.Path,
+		maxSize:     cfg.MaxSize,
+		maxFiles:    cfg.MaxFiles,
+		subscribers: map[chan Event]bool{},
+	}
+
+	if l.maxSize == 0 {
+		l.maxSize = DefaultEventLogMaxSize
+	}
+	if l.maxFiles == 0 {
+		l.maxFiles = DefaultEventLogMaxFiles
+	}
+
+	err := l.open()
+	if err != nil {
+		return nil, err
+	}
+
+	return l, nil
+}
+
+func (l *EventLog) open() error {
+	f, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	l.file = f
+	l.size = info.Size()
+
+	return nil
+}
+
+func (l *EventLog) rotatedPath(n int) string {
+	return fmt.Sprintf("%s.%d", l.path, n)
+}
+
+// rotate moves path to path.1, path.1 to path.2 and so on, dropping the
+// oldest file
+func (l *EventLog) rotate() error {
+	err := l.file.Close()
+	if err != nil {
+		return err
+	}
+
+	os.Remove(l.rotatedPath(l.maxFiles - 1))
+	for n := l.maxFiles - 2; n >= 1; n-- {
+		os.Rename(l.rotatedPath(n), l.rotatedPath(n+1))
+	}
+
+	if l.maxFiles > 1 {
+		err = os.Rename(l.path, l.rotatedPath(1))
+	} else {
+		err = os.Remove(l.path)
+	}
+	if err != nil {
+		return err
+	}
+
+	return l.open()
+}
+
+// Record appends an event, timestamping it if not already
+func (l *EventLog) Record(e Event) {
+	if l == nil {
+		return
+	}
+
+	if e.Time.IsZero() {
+		e.Time = time.Now()
+	}
+
+	data, err := json.Marshal(&e)
+	if err != nil {
+		log.Printf("Failed to encode event: %v", err)
+		return
+	}
+	data = append(data, '\n')
+
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	if l.size > 0 && l.size+int64(len(data)) > l.maxSize {
+		err = l.rotate()
+		if err != nil {
+			log.Printf("Failed to rotate event log: %v", err)
+			return
+		}
+	}
+
+	n, err := l.file.Write(data)
+	l.size += int64(n)
+	if err != nil {
+		log.Printf("Failed to write event log: %v", err)
+	}
+
+	for ch := range l.subscribers {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Query reads matching events from the log files, oldest first
+func (l *EventLog) Query(q EventQuery) ([]Event, error) {
+	result := []Event{}
+	if l == nil {
+		return result, nil
+	}
+
+	files, err := l.openFiles()
+	if err != nil {
+		return nil, err
+	}
+
+	// Scan without the lock, which Record takes while the device manager
+	// is locked.  Open files are unaffected by rotation renaming them.
+	for i, f := range files {
+		scanner := bufio.NewScanner(f)
+		for scanner.Scan() {
+			e := Event{}
+			if json.Unmarshal(scanner.Bytes(), &e) != nil {
+				// Torn final line after a crash, or being written
+				continue
+			}
+
+			if q.matches(&e) {
+				result = append(result, e)
+			}
+		}
+		err = scanner.Err()
+		if err != nil {
+			for _, f := range files[i:] {
+				f.Close()
+			}
+			return nil, err
+		}
+		f.Close()
+	}
+
+	if q.Limit > 0 && len(result) > q.Limit {
+		result = result[len(result)-q.Limit:]
+	}
+
+	return result, nil
+}
+
+// openFiles opens the existing log files, oldest first
+func (l *EventLog) openFiles() ([]*os.File, error) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	paths := []string{}
+	for n := l.maxFiles - 1; n >= 1; n-- {
+		paths = append(paths, l.rotatedPath(n))
+	}
+	paths = append(paths, l.path)
+
+	files := []*os.File{}
+	for _, path := range paths {
+		f, err := os.Open(path)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		} else if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, err
+		}
+		files = append(files, f)
+	}
+
+	return files, nil
+}
+
+// Subscribe gets a channel of new events, which drops events if not
+// read promptly
+func (l *EventLog) Subscribe() chan Event {
+	ch := make(chan Event, 100)
+
+	if l != nil {
+		l.lock.Lock()
+		l.subscribers[ch] = true
+		l.lock.Unlock()
+	}
+
+	return ch
+}
+
+func (l *EventLog) Unsubscribe(ch chan Event) {
+	if l == nil {
+		return
+	}
+
+	l.lock.Lock()
+	delete(l.subscribers, ch)
+	l.lock.Unlock()
+}
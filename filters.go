@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/netleapio/zappy-framework/protocol"
+)
+
+// Filter types
+const (
+	FilterRange  = "range"
+	FilterRate   = "rate"
+	FilterMedian = "median"
+	FilterEMA    = "ema"
+)
+
+// rateFilterResync is the number of consecutive samples the rate filter
+// rejects before accepting a step change as genuine
+const rateFilterResync = 3
+
+// readingFilter is one stage of a sensor type's filter chain
+type readingFilter interface {
+	// apply returns the filtered value, or false to reject the sample
+	apply(st *filterState, v float64, now time.Time) (float64, bool)
+}
+
+// filterState is the per-device state of one filter stage
+type filterState struct {
+	last     float64
+	lastTime time.Time
+	rejects  int
+	window   []float64
+}
+
+type rangeFilter struct {
+	min *float64
+	max *float64
+}
+
+func (f *rangeFilter) apply(st *filterState, v float64, now time.Time) (float64, bool) {
+	if (f.min != nil && v < *f.min) || (f.max != nil && v > *f.max) {
+		return v, false
+	}
+
+	return v, true
+}
+
+type rateFilter struct {
+	maxPerMinute float64
+}
+
+func (f *rateFilter) apply(st *filterState, v float64, now time.Time) (float64, bool) {
+	if !st.lastTime.IsZero() && st.rejects < rateFilterResync {
+		minutes := math.Max(now.Sub(st.lastTime).Minutes(), 1.0/60)
+		if math.Abs(v-st.last)/minutes > f.maxPerMinute {
+			st.rejects++
+			return v, false
+		}
+	}
+
+	st.last = v
+	st.lastTime = now
+	st.rejects = 0
+
+	return v, true
+}
+
+type medianFilter struct {
+	size int
+}
+
+func (f *medianFilter) apply(st *filterState, v float64, now time.Time) (float64, bool) {
+	st.window = appendWindow(st.window, v, f.size)
+
+	sorted := append([]float64(nil), st.window...)
+	sort.Float64s(sorted)
+
+	n := len(sorted)
+	if n%2 == 0 {
+		return (sorted[n/2-1] + sorted[n/2]) / 2, true
+	}
+
+	return sorted[n/2], true
+}
+
+type emaFilter struct {
+	alpha float64
+}
+
+func (f *emaFilter) apply(st *filterState, v float64, now time.Time) (float64, bool) {
+	if st.lastTime.IsZero() {
+		st.last = v
+	} else {
+		st.last += f.alpha * (v - st.last)
+	}
+	st.lastTime = now
+
+	return st.last, true
+}
+
+func compileFilter(fs *FilterSettings) (readingFilter, error) {
+	switch fs.Type {
+	case FilterRange:
+		if fs.Min == nil && fs.Max == nil {
+			return nil, fmt.Errorf("range filter needs min and/or max")
+		}
+		return &rangeFilter{min: fs.Min, max: fs.Max}, nil
+	case FilterRate:
+		if fs.MaxRate <= 0 {
+			return nil, fmt.Errorf("rate filter needs a positive maxRate")
+		}
+		return &rateFilter{maxPerMinute: fs.MaxRate}, nil
+	case FilterMedian:
+		if fs.Window < 1 {
+			return nil, fmt.Errorf("median filter needs a positive window")
+		}
+		return &medianFilter{size: fs.Window}, nil
+	case FilterEMA:
+		if fs.Alpha <= 0 || fs.Alpha > 1 {
+			return nil, fmt.Errorf("ema filter needs alpha in (0, 1]")
+		}
+		return &emaFilter{alpha: fs.Alpha}, nil
+	}
+
+	return nil, fmt.Errorf("unknown filter type '%s'", fs.Type)
+}
+
+// filter runs a sample through the filter chain of its sensor type,
+// counting rejected samples.  Must be called with the lock held.
+func (m *DeviceManager) filter(d *DeviceState, t protocol.SensorType, v float64, now time.Time) (float64, bool) {
+	chain := m.filters[t]
+	if len(chain) == 0 {
+		return v, true
+	}
+
+	states, ok := d.filters[t]
+	if !ok {
+		states = make([]filterState, len(chain))
+		d.filters[t] = states
+	}
+
+	for i, f := range chain {
+		var accepted bool
+		v, accepted = f.apply(&states[i], v, now)
+		if !accepted {
+			d.rejected[t]++
+			return v, false
+		}
+	}
+
+	return v, true
+}
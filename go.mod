@@ -3,6 +3,7 @@ module github.com/netleapio/zappy-controller
 go 1.19
 
 require (
+	github.com/eclipse/paho.golang v0.11.0
 	github.com/eclipse/paho.mqtt.golang v1.4.3
 	github.com/gorilla/websocket v1.5.1
 	github.com/netleapio/zappy-framework v0.1.1
@@ -1,61 +1,214 @@
 package hassiomqtt
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"sync"
 	"time"
-
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 )
 
 type Client struct {
-	Client          mqtt.Client
+	transport       transport
 	id              string
 	DiscoveryPrefix string
-	entities        map[string]*Sensor // Change Sensor to a generic Entity in future
+	lock            sync.Mutex
+	entities        map[string]Entity
+	subscriptions   map[string]CommandHandler
+	onRefresh       []func()
 }
 
-func NewClient(broker string, port int, clientId string, user string, password string) *Client {
-	opts := mqtt.NewClientOptions()
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", broker, port))
-	opts.SetClientID(clientId)
-	opts.SetUsername(user)
-	opts.SetPassword(password)
-	opts.SetCleanSession(true)
-	opts.SetAutoReconnect(true)
+// ClientOptions configure the connection to the broker
+type ClientOptions struct {
+	// Brokers are URLs, such as "tcp://broker:1883", tried in order
+	Brokers []string
+
+	ClientID string
+	User     string
+	Password string
+
+	// TLS configures ssl:// and wss:// connections, defaults if nil
+	TLS *tls.Config
+
+	// Version of MQTT, 3 (for 3.1.1) or 5.  Defaults to 3.
+	Version int
 
+	// SharedGroup, with MQTT 5, makes command subscriptions shared by a
+	// group of controllers, so each command is handled once
+	SharedGroup string
+
+	// StateExpiry, with MQTT 5, is how long state messages are kept for
+	// subscribers before being dropped as out of date
+	StateExpiry time.Duration
+}
+
+func NewClient(options *ClientOptions) (*Client, error) {
 	c := &Client{
-		id:              clientId,
+		id:              options.ClientID,
 		DiscoveryPrefix: "homeassistant",
-		entities:        make(map[string]*Sensor),
+		entities:        make(map[string]Entity),
+		subscriptions:   make(map[string]CommandHandler),
+	}
+
+	switch options.Version {
+	case 0, 3:
+		c.transport = newTransport3(options)
+	case 5:
+		t, err := newTransport5(options)
+		if err != nil {
+			return nil, err
+		}
+		c.transport = t
+	default:
+		return nil, fmt.Errorf("unsupported MQTT version %d", options.Version)
 	}
 
-	c.Client = mqtt.NewClient(opts)
-	return c
+	return c, nil
 }
 
-func (c *Client) Start() {
-	go func() {
-		for !c.Client.IsConnected() {
-			tok := c.Client.Connect()
-			ok := tok.WaitTimeout(time.Second)
-			if !ok {
-				println("timeout connecting to MQTT broker, retrying")
-				continue
-			}
-			err := tok.Error()
-			if err != nil {
-				fmt.Printf("error connecting to MQTT broker: %v\n", err)
-				time.Sleep(5 * time.Second)
-			}
+// BridgeAvailabilityTopic reports whether the controller itself is
+// connected, going offline via the Last Will if it drops off
+func (c *Client) BridgeAvailabilityTopic() string {
+	return fmt.Sprintf("%s/%s/availability", c.DiscoveryPrefix, c.id)
+}
+
+// CommandTopic is the topic commands for the controller itself are
+// received on
+func (c *Client) CommandTopic() string {
+	return fmt.Sprintf("%s/%s/command", c.DiscoveryPrefix, c.id)
+}
+
+// AckTopic is the topic the outcome of commands is published to
+func (c *Client) AckTopic() string {
+	return fmt.Sprintf("%s/%s/command/ack", c.DiscoveryPrefix, c.id)
+}
+
+// Subscribe calls a handler with commands received on a topic, including
+// after reconnecting
+func (c *Client) Subscribe(topic string, onMessage CommandHandler) error {
+	c.lock.Lock()
+	c.subscriptions[topic] = onMessage
+	c.lock.Unlock()
+
+	if !c.IsConnected() {
+		return nil
+	}
+
+	return c.subscribe(topic, onMessage)
+}
+
+// subscribe to a command topic, shared with other controllers if
+// configured
+func (c *Client) subscribe(topic string, onMessage CommandHandler) error {
+	return c.transport.subscribe(topic, true, func(payload []byte) {
+		onMessage(string(payload))
+	})
+}
+
+func (c *Client) unsubscribe(topic string) error {
+	return c.transport.unsubscribe(topic, true)
+}
+
+// Publish sends a message to the broker
+func (c *Client) Publish(m *Message) error {
+	if !c.IsConnected() {
+		return errors.New("not connected to MQTT broker")
+	}
+
+	return c.transport.publish(m)
+}
+
+// IsConnected checks the client has been started and is connected
+func (c *Client) IsConnected() bool {
+	return c != nil && c.transport.isConnected()
+}
+
+// AddOnRefresh adds a function called after discovery config has been
+// republished, on (re)connecting or when Home Assistant restarts, so that
+// state can be republished too
+func (c *Client) AddOnRefresh(fn func()) {
+	c.onRefresh = append(c.onRefresh, fn)
+}
+
+// Entities gets a copy of the entities by id
+func (c *Client) Entities() map[string]Entity {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	result := make(map[string]Entity, len(c.entities))
+	for k, v := range c.entities {
+		result[k] = v
+	}
+
+	return result
+}
+
+func (c *Client) addEntity(id string, e Entity) {
+	c.lock.Lock()
+	c.entities[id] = e
+	c.lock.Unlock()
+}
+
+func (c *Client) removeEntity(id string) {
+	c.lock.Lock()
+	delete(c.entities, id)
+	c.lock.Unlock()
+}
+
+func (c *Client) refreshAll() {
+	for k, v := range c.Entities() {
+		println("refreshing:", k)
+		v.Refresh()
+	}
+
+	for _, fn := range c.onRefresh {
+		fn()
+	}
+}
+
+// connected runs on every connection, as a clean session loses
+// subscriptions and the broker may have lost retained messages
+func (c *Client) connected() {
+	c.transport.publish(&Message{Topic: c.BridgeAvailabilityTopic(), QOS: 1, Retained: true, Payload: []byte(PayloadAvailable)})
+
+	c.transport.subscribe(c.DiscoveryPrefix+"/status", false, func(payload []byte) {
+		println("hass status changed:", string(payload))
+
+		if string(payload) == PayloadAvailable {
+			go c.refreshAll()
 		}
+	})
+
+	// A clean session loses command subscriptions
+	c.lock.Lock()
+	subscriptions := make(map[string]CommandHandler, len(c.subscriptions))
+	for topic, fn := range c.subscriptions {
+		subscriptions[topic] = fn
+	}
+	c.lock.Unlock()
 
-		c.Client.Subscribe("homeassistant/status", 0, func(cl mqtt.Client, m mqtt.Message) {
-			println("hass status changed:", string(m.Payload()))
+	for topic, fn := range subscriptions {
+		err := c.subscribe(topic, fn)
+		if err != nil {
+			fmt.Printf("error subscribing to %s: %v\n", topic, err)
+		}
+	}
 
-			for k, v := range c.entities {
-				println("refreshing:", k)
-				v.Refresh()
-			}
-		})
-	}()
+	for _, e := range c.Entities() {
+		err := e.subscribe()
+		if err != nil {
+			fmt.Printf("error subscribing to %s commands: %v\n", e.ID(), err)
+		}
+	}
+
+	go c.refreshAll()
+}
+
+func (c *Client) Start() {
+	will := &Message{Topic: c.BridgeAvailabilityTopic(), QOS: 1, Retained: true, Payload: []byte(PayloadNotAvailable)}
+
+	err := c.transport.start(will, c.connected)
+	if err != nil {
+		fmt.Printf("error starting MQTT client: %v\n", err)
+	}
 }
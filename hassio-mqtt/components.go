@@ -0,0 +1,146 @@
+package hassiomqtt
+
+import (
+	"encoding/json"
+)
+
+// Sensor reports a value from the device's state
+type Sensor struct{ *entity }
+
+func NewSensor(device *Device, id string, model *SensorModel) (*Sensor, error) {
+	m := *model
+	e, err := newEntity(device, "sensor", id, &m, device.statusTopic, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Sensor{e}, nil
+}
+
+// BinarySensor reports an on/off value from the device's state
+type BinarySensor struct{ *entity }
+
+func NewBinarySensor(device *Device, id string, model *BinarySensorModel) (*BinarySensor, error) {
+	m := *model
+	e, err := newEntity(device, "binary_sensor", id, &m, device.statusTopic, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &BinarySensor{e}, nil
+}
+
+// Switch is turned on and off from HASS, its state sent with SendState
+type Switch struct{ *entity }
+
+func NewSwitch(device *Device, id string, model *SwitchModel, onCommand CommandHandler) (*Switch, error) {
+	m := *model
+	e, err := newEntity(device, "switch", id, &m, device.EntityStateTopic(id), onCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Switch{e}, nil
+}
+
+// Number is set from HASS, its state sent with SendState
+type Number struct{ *entity }
+
+func NewNumber(device *Device, id string, model *NumberModel, onCommand CommandHandler) (*Number, error) {
+	m := *model
+	e, err := newEntity(device, "number", id, &m, device.EntityStateTopic(id), onCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Number{e}, nil
+}
+
+// Select is one of a list of options chosen from HASS, its state sent
+// with SendState
+type Select struct{ *entity }
+
+func NewSelect(device *Device, id string, model *SelectModel, onCommand CommandHandler) (*Select, error) {
+	m := *model
+	e, err := newEntity(device, "select", id, &m, device.EntityStateTopic(id), onCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Select{e}, nil
+}
+
+// Text is set from HASS, its state sent with SendState
+type Text struct{ *entity }
+
+func NewText(device *Device, id string, model *TextModel, onCommand CommandHandler) (*Text, error) {
+	m := *model
+	e, err := newEntity(device, "text", id, &m, device.EntityStateTopic(id), onCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Text{e}, nil
+}
+
+// Button is pressed from HASS, and has no state
+type Button struct{ *entity }
+
+func NewButton(device *Device, id string, model *ButtonModel, onCommand CommandHandler) (*Button, error) {
+	m := *model
+	e, err := newEntity(device, "button", id, &m, "", onCommand)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Button{e}, nil
+}
+
+// EventEntity reports events of the types listed in its model
+type EventEntity struct{ *entity }
+
+func NewEvent(device *Device, id string, model *EventModel) (*EventEntity, error) {
+	m := *model
+	e, err := newEntity(device, "event", id, &m, device.EntityStateTopic(id), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return &EventEntity{e}, nil
+}
+
+// Fire sends an event, with optional attributes
+func (e *EventEntity) Fire(eventType string, attributes map[string]interface{}) error {
+	payload := map[string]interface{}{}
+	for k, v := range attributes {
+		payload[k] = v
+	}
+	payload["event_type"] = eventType
+
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+
+	return e.SendState(data)
+}
+
+// DeviceTrigger lets HASS automations trigger on something happening to
+// a device
+type DeviceTrigger struct{ *entity }
+
+func NewDeviceTrigger(device *Device, id string, model *DeviceTriggerModel) (*DeviceTrigger, error) {
+	m := *model
+	e, err := newEntity(device, "device_automation", id, &m, device.EntityStateTopic(id), nil)
+	if err != nil {
+		return nil, err
+	}
+	e.stateTopic = m.Topic
+
+	return &DeviceTrigger{e}, nil
+}
+
+// Fire sends the payload that triggers the automation
+func (t *DeviceTrigger) Fire(payload string) error {
+	return t.SendState(payload)
+}
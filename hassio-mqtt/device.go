@@ -2,7 +2,11 @@ package hassiomqtt
 
 import (
 	"fmt"
-	"time"
+)
+
+const (
+	PayloadAvailable    = "online"
+	PayloadNotAvailable = "offline"
 )
 
 type Device struct {
@@ -23,14 +27,98 @@ func NewDevice(client *Client, id string, model *DeviceModel) *Device {
 }
 
 func (d *Device) SendStatus(status interface{}) error {
-	tok := d.client.Client.Publish(d.statusTopic, 0, false, status)
-	for {
-		ok := tok.WaitTimeout(time.Second)
-		if ok {
-			break
+	return d.publish(&Message{Topic: d.statusTopic, Payload: payloadBytes(status), State: true})
+}
+
+// publish sends a message about the device, identified by its user
+// properties with MQTT 5
+func (d *Device) publish(m *Message) error {
+	m.UserProperties = map[string]string{"device": d.id}
+	return d.client.Publish(m)
+}
+
+// CommandTopic is the topic HASS publishes commands for one of the
+// device's entities to
+func (d *Device) CommandTopic(entityId string) string {
+	return fmt.Sprintf("%s/%s/%s/set", d.client.DiscoveryPrefix, d.id, entityId)
+}
+
+// EntityStateTopic is the state topic of an entity that does not share
+// the device's state
+func (d *Device) EntityStateTopic(entityId string) string {
+	return fmt.Sprintf("%s/%s/%s/state", d.client.DiscoveryPrefix, d.id, entityId)
+}
+
+// DeviceAvailabilityTopic is the topic used to report availability of the
+// whole device
+func (d *Device) DeviceAvailabilityTopic() string {
+	return fmt.Sprintf("%s/%s/availability", d.client.DiscoveryPrefix, d.id)
+}
+
+// Availability lists the topics an entity's availability depends on: the
+// bridge, the device and the entity itself, for use with
+// availability_mode 'all'
+func (d *Device) Availability(entityId string) []AvailabilityModel {
+	return append(d.DeviceAvailability(), AvailabilityModel{Topic: d.AvailabilityTopic(entityId)})
+}
+
+// DeviceAvailability lists the topics the availability of an entity
+// without its own availability depends on: the bridge and the device
+func (d *Device) DeviceAvailability() []AvailabilityModel {
+	return []AvailabilityModel{
+		{Topic: d.client.BridgeAvailabilityTopic()},
+		{Topic: d.DeviceAvailabilityTopic()},
+	}
+}
+
+// Rename changes the name of the device, publishing the discovery config
+// of its entities again
+func (d *Device) Rename(name string) error {
+	d.model.Name = name
+
+	var result error
+	for _, e := range d.client.Entities() {
+		if e.owner() != d {
+			continue
+		}
+
+		err := e.Refresh()
+		if err != nil {
+			result = err
 		}
-		println("sendstatus: retry")
 	}
 
-	return tok.Error()
+	return result
+}
+
+// SendDeviceAvailability publishes (retained) whether the device is
+// available
+func (d *Device) SendDeviceAvailability(available bool) error {
+	return d.publishAvailability(d.DeviceAvailabilityTopic(), available)
+}
+
+// AvailabilityTopic is the topic used to report availability of one of
+// the device's entities
+func (d *Device) AvailabilityTopic(entityId string) string {
+	return fmt.Sprintf("%s/%s/%s/availability", d.client.DiscoveryPrefix, d.id, entityId)
+}
+
+// SendAvailability publishes (retained) whether an entity is available
+func (d *Device) SendAvailability(entityId string, available bool) error {
+	return d.publishAvailability(d.AvailabilityTopic(entityId), available)
+}
+
+func (d *Device) publishAvailability(topic string, available bool) error {
+	payload := PayloadNotAvailable
+	if available {
+		payload = PayloadAvailable
+	}
+
+	return d.publish(&Message{Topic: topic, QOS: 1, Retained: true, Payload: []byte(payload)})
+}
+
+// ClearAvailability removes the retained availability of an entity that
+// no longer exists
+func (d *Device) ClearAvailability(entityId string) error {
+	return d.publish(&Message{Topic: d.AvailabilityTopic(entityId), QOS: 1, Retained: true})
 }
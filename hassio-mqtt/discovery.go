@@ -48,18 +48,18 @@ type DeviceModel struct {
 type AvailabilityModel struct {
 	// The value (after processing with `value_template`) indicating
 	// the entity is available.
-	PayloadAvailable string `json:"payload_available"`
+	PayloadAvailable string `json:"payload_available,omitempty"`
 
 	// The value (after processing with `availability_template`) indicating
 	// the entity is not available.
-	PayloadNotAvailable string `json:"payload_not_available"`
+	PayloadNotAvailable string `json:"payload_not_available,omitempty"`
 
 	// An MQTT topic subscribed to receive availability (online/offline) updates.
 	Topic string `json:"topic"`
 
 	// A template used to extract availability from Topic.  The result of this
 	// template is compared to PayloadAvailable and PayloadNotAvailable.
-	ValueTemplate string `json:"value_template"`
+	ValueTemplate string `json:"value_template,omitempty"`
 }
 
 type EntityModel struct {
@@ -133,20 +133,151 @@ type SensorModel struct {
 	UnitOfMeasurement string `json:"unit_of_measurement,omitempty"`
 }
 
-type SwitchModel struct {
+// CommandModel is embedded in the models of entities that accept
+// commands
+type CommandModel struct {
+	// CommandTopic is the topic HASS publishes commands to, set when the
+	// entity is created
+	CommandTopic string `json:"command_topic"`
+
+	// CommandTemplate formats the command payload
+	CommandTemplate string `json:"command_template,omitempty"`
+
+	// Retain commands published by HASS
+	Retain *bool `json:"retain,omitempty"`
+}
+
+func (m *CommandModel) commandModel() *CommandModel {
+	return m
+}
+
+type BinarySensorModel struct {
 	EntityModel
 
-	CommandTopic string `json:"command_topic"`
+	// ExpireAfter is the number of seconds after which the state expires
+	// if not updated
+	ExpireAfter int `json:"expire_after,omitempty"`
 
-	Optimistic *bool `json:"optimistic,omitempty"`
+	// OffDelay is the number of seconds after which the sensor resets to
+	// off, for sensors that only send on
+	OffDelay int `json:"off_delay,omitempty"`
 
 	PayloadOff string `json:"payload_off,omitempty"`
 
 	PayloadOn string `json:"payload_on,omitempty"`
+}
 
-	Retain *bool `json:"retain,omitempty"`
+type SwitchModel struct {
+	EntityModel
+	CommandModel
+
+	Optimistic *bool `json:"optimistic,omitempty"`
+
+	PayloadOff string `json:"payload_off,omitempty"`
+
+	PayloadOn string `json:"payload_on,omitempty"`
 
 	StateOn string `json:"state_on,omitempty"`
 
 	StateOff string `json:"state_off,omitempty"`
 }
+
+type NumberModel struct {
+	EntityModel
+	CommandModel
+
+	Min *float64 `json:"min,omitempty"`
+
+	Max *float64 `json:"max,omitempty"`
+
+	// Mode is 'auto', 'box' or 'slider'
+	Mode string `json:"mode,omitempty"`
+
+	Optimistic *bool `json:"optimistic,omitempty"`
+
+	Step *float64 `json:"step,omitempty"`
+
+	UnitOfMeasurement string `json:"unit_of_measurement,omitempty"`
+}
+
+type SelectModel struct {
+	EntityModel
+	CommandModel
+
+	Optimistic *bool `json:"optimistic,omitempty"`
+
+	// Options that can be selected
+	Options []string `json:"options"`
+}
+
+type ButtonModel struct {
+	EntityModel
+	CommandModel
+
+	// PayloadPress is sent when the button is pressed
+	PayloadPress string `json:"payload_press,omitempty"`
+}
+
+type TextModel struct {
+	EntityModel
+	CommandModel
+
+	// Min and Max length of the text
+	Min *int `json:"min,omitempty"`
+	Max *int `json:"max,omitempty"`
+
+	// Mode is 'text' or 'password'
+	Mode string `json:"mode,omitempty"`
+
+	// Pattern is a regex the text must match
+	Pattern string `json:"pattern,omitempty"`
+}
+
+type EventModel struct {
+	EntityModel
+
+	// EventTypes lists the event_type values the entity can fire
+	EventTypes []string `json:"event_types"`
+}
+
+// DeviceTriggerModel is the discovery payload of a device trigger, which
+// unlike other components is not an entity
+type DeviceTriggerModel struct {
+	// AutomationType is always 'trigger', set when created
+	AutomationType string `json:"automation_type"`
+
+	// Device the trigger belongs to, set when created
+	Device *DeviceModel `json:"device"`
+
+	// Payload that fires the trigger, any payload if empty
+	Payload string `json:"payload,omitempty"`
+
+	QOS *int `json:"qos,omitempty"`
+
+	// Topic that fires the trigger, set when created if empty
+	Topic string `json:"topic"`
+
+	// Type of trigger, eg. 'button_short_press' or a custom type
+	Type string `json:"type"`
+
+	// Subtype of trigger, eg. 'button_1' or a custom subtype
+	Subtype string `json:"subtype"`
+
+	ValueTemplate string `json:"value_template,omitempty"`
+}
+
+func (m *EntityModel) setDefaults(id string, device *DeviceModel, stateTopic string) {
+	m.UniqueID = id
+	m.Device = device
+	if m.StateTopic == "" {
+		m.StateTopic = stateTopic
+	}
+}
+
+func (m *DeviceTriggerModel) setDefaults(id string, device *DeviceModel, stateTopic string) {
+	m.AutomationType = "trigger"
+	m.Device = device
+	if m.Topic == "" {
+		m.Topic = stateTopic
+	}
+}
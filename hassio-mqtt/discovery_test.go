@@ -0,0 +1,317 @@
+package hassiomqtt
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "update golden files")
+
+// fakeTransport records published messages
+type fakeTransport struct {
+	lock      sync.Mutex
+	published []*Message
+	handlers  map[string]func(payload []byte)
+}
+
+func (t *fakeTransport) start(will *Message, onConnect func()) error { return nil }
+
+func (t *fakeTransport) isConnected() bool { return true }
+
+func (t *fakeTransport) publish(m *Message) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.published = append(t.published, m)
+	return nil
+}
+
+func (t *fakeTransport) subscribe(topic string, shared bool, onMessage func(payload []byte)) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.handlers[topic] = onMessage
+	return nil
+}
+
+func (t *fakeTransport) unsubscribe(topic string, shared bool) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.handlers, topic)
+	return nil
+}
+
+// lastPayload gets the payload last published to a topic
+func (t *fakeTransport) lastPayload(topic string) ([]byte, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	for i := len(t.published) - 1; i >= 0; i-- {
+		if t.published[i].Topic == topic {
+			return t.published[i].Payload, true
+		}
+	}
+
+	return nil, false
+}
+
+func newTestDevice() (*Device, *fakeTransport) {
+	transport := &fakeTransport{handlers: map[string]func(payload []byte){}}
+	client := &Client{
+		transport:       transport,
+		id:              "zappy",
+		DiscoveryPrefix: "homeassistant",
+		entities:        map[string]Entity{},
+		subscriptions:   map[string]CommandHandler{},
+	}
+
+	device := NewDevice(client, "zappy_0102", &DeviceModel{
+		Identifiers:  []string{"zappy_0102"},
+		Manufacturer: "netleap",
+		Model:        "Weather Station",
+		Name:         "Garden",
+		ViaDevice:    "zappy",
+	})
+
+	return device, transport
+}
+
+func configTopic(component string, id string) string {
+	return "homeassistant/" + component + "/zappy/" + id + "/config"
+}
+
+func ignoreCommand(payload string) {}
+
+func TestDiscoveryPayloads(t *testing.T) {
+	min, max, step := 1.0, 3600.0, 1.0
+	minLen, maxLen := 1, 32
+	disabled := false
+
+	tests := []struct {
+		component string
+		create    func(d *Device) (Entity, error)
+	}{
+		{"sensor", func(d *Device) (Entity, error) {
+			return NewSensor(d, "zappy_0102_temperature", &SensorModel{
+				EntityModel: EntityModel{
+					Availability:     d.Availability("zappy_0102_temperature"),
+					AvailabilityMode: "all",
+					DeviceClass:      "temperature",
+					Name:             "temperature",
+					ObjectID:         "zappy_0102_temperature",
+					ValueTemplate:    "{{value_json.temperature}}",
+				},
+				SuggestedDisplayPrecision: 2,
+				StateClass:                "measurement",
+				UnitOfMeasurement:         "°C",
+			})
+		}},
+		{"binary_sensor", func(d *Device) (Entity, error) {
+			return NewBinarySensor(d, "zappy_0102_alert_battery_low", &BinarySensorModel{
+				EntityModel: EntityModel{
+					Availability:     d.DeviceAvailability(),
+					AvailabilityMode: "all",
+					DeviceClass:      "battery",
+					EntityCategory:   "diagnostic",
+					Name:             "battery_low",
+					ObjectID:         "zappy_0102_alert_battery_low",
+					ValueTemplate:    "{{value_json.alert_battery_low}}",
+				},
+			})
+		}},
+		{"switch", func(d *Device) (Entity, error) {
+			return NewSwitch(d, "zappy_0102_coils", &SwitchModel{
+				EntityModel: EntityModel{Name: "coils", ObjectID: "zappy_0102_coils"},
+			}, ignoreCommand)
+		}},
+		{"number", func(d *Device) (Entity, error) {
+			return NewNumber(d, "zappy_0102_report_interval", &NumberModel{
+				EntityModel:       EntityModel{EntityCategory: "config", Name: "report interval"},
+				Min:               &min,
+				Max:               &max,
+				Step:              &step,
+				Mode:              "box",
+				UnitOfMeasurement: "s",
+			}, ignoreCommand)
+		}},
+		{"select", func(d *Device) (Entity, error) {
+			return NewSelect(d, "zappy_0102_mode", &SelectModel{
+				EntityModel: EntityModel{EntityCategory: "config", Name: "mode"},
+				Options:     []string{"eco", "normal"},
+			}, ignoreCommand)
+		}},
+		{"button", func(d *Device) (Entity, error) {
+			return NewButton(d, "zappy_0102_identify", &ButtonModel{
+				EntityModel: EntityModel{DeviceClass: "identify", Name: "identify"},
+			}, ignoreCommand)
+		}},
+		{"text", func(d *Device) (Entity, error) {
+			return NewText(d, "zappy_0102_rename", &TextModel{
+				EntityModel: EntityModel{EntityCategory: "config", Name: "name", EnabledByDefault: &disabled},
+				Min:         &minLen,
+				Max:         &maxLen,
+			}, ignoreCommand)
+		}},
+		{"event", func(d *Device) (Entity, error) {
+			return NewEvent(d, "zappy_0102_alert", &EventModel{
+				EntityModel: EntityModel{Name: "alert"},
+				EventTypes:  []string{"raised", "cleared"},
+			})
+		}},
+		{"device_automation", func(d *Device) (Entity, error) {
+			return NewDeviceTrigger(d, "zappy_0102_alert_raised_battery_low", &DeviceTriggerModel{
+				Type:    "alert_raised",
+				Subtype: "battery_low",
+			})
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.component, func(t *testing.T) {
+			device, transport := newTestDevice()
+
+			e, err := tt.create(device)
+			if err != nil {
+				t.Fatalf("creating %s: %v", tt.component, err)
+			}
+			if e.Component() != tt.component {
+				t.Errorf("component %q, want %q", e.Component(), tt.component)
+			}
+
+			payload, ok := transport.lastPayload(configTopic(tt.component, e.ID()))
+			if !ok {
+				t.Fatalf("no config published to %s", configTopic(tt.component, e.ID()))
+			}
+
+			got := bytes.Buffer{}
+			err = json.Indent(&got, payload, "", "  ")
+			if err != nil {
+				t.Fatalf("bad JSON %s: %v", payload, err)
+			}
+			got.WriteByte('\n')
+
+			golden := filepath.Join("testdata", tt.component+".json")
+			if *update {
+				err = os.WriteFile(golden, got.Bytes(), 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(golden)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got.Bytes(), want) {
+				t.Errorf("%s payload differs from %s:\n%s", tt.component, golden, got.String())
+			}
+		})
+	}
+}
+
+func TestDeviceTriggerPayload(t *testing.T) {
+	device, transport := newTestDevice()
+
+	trigger, err := NewDeviceTrigger(device, "zappy_0102_alert_cleared_rtc_failure", &DeviceTriggerModel{
+		Type:    "alert_cleared",
+		Subtype: "rtc_failure",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, ok := transport.lastPayload(configTopic("device_automation", trigger.ID()))
+	if !ok {
+		t.Fatal("no config published")
+	}
+
+	fields := map[string]interface{}{}
+	err = json.Unmarshal(payload, &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	required := map[string]interface{}{
+		"automation_type": "trigger",
+		"topic":           device.EntityStateTopic(trigger.ID()),
+		"type":            "alert_cleared",
+		"subtype":         "rtc_failure",
+	}
+	for k, want := range required {
+		if fields[k] != want {
+			t.Errorf("%s is %v, want %v", k, fields[k], want)
+		}
+	}
+
+	if d, ok := fields["device"].(map[string]interface{}); !ok || d["name"] != "Garden" {
+		t.Errorf("device is %v", fields["device"])
+	}
+
+	for _, k := range []string{"unique_id", "object_id", "name", "state_topic", "command_topic", "availability", "availability_mode", "device_class", "entity_category"} {
+		if _, ok := fields[k]; ok {
+			t.Errorf("device trigger has entity field %s", k)
+		}
+	}
+
+	// Firing publishes to the trigger's topic
+	err = trigger.Fire("alert_cleared")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fired, ok := transport.lastPayload(device.EntityStateTopic(trigger.ID()))
+	if !ok || string(fired) != "alert_cleared" {
+		t.Errorf("fired %q, want %q", fired, "alert_cleared")
+	}
+}
+
+func TestCommandTopics(t *testing.T) {
+	device, transport := newTestDevice()
+
+	received := ""
+	e, err := NewSwitch(device, "zappy_0102_coils", &SwitchModel{}, func(payload string) {
+		received = payload
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload, _ := transport.lastPayload(configTopic("switch", e.ID()))
+	fields := map[string]interface{}{}
+	err = json.Unmarshal(payload, &fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	topic := device.CommandTopic(e.ID())
+	if fields["command_topic"] != topic {
+		t.Errorf("command_topic is %v, want %s", fields["command_topic"], topic)
+	}
+
+	handler, ok := transport.handlers[topic]
+	if !ok {
+		t.Fatalf("not subscribed to %s", topic)
+	}
+	handler([]byte("ON"))
+	if received != "ON" {
+		t.Errorf("received %q, want ON", received)
+	}
+
+	// Removing the entity unsubscribes and clears the retained config
+	err = e.Remove()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := transport.handlers[topic]; ok {
+		t.Errorf("still subscribed to %s", topic)
+	}
+	if payload, _ := transport.lastPayload(configTopic("switch", e.ID())); len(payload) != 0 {
+		t.Errorf("config not cleared: %s", payload)
+	}
+}
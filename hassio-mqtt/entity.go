@@ -0,0 +1,133 @@
+package hassiomqtt
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// Entity is anything published to HASS via discovery
+type Entity interface {
+	// ID uniquely identifies the entity
+	ID() string
+
+	// Component is the HASS integration, eg. 'sensor' or 'switch'
+	Component() string
+
+	// Refresh publishes the discovery config again
+	Refresh() error
+
+	// Remove deletes the entity from HASS
+	Remove() error
+
+	// subscribe to the entity's command topic, if any
+	subscribe() error
+
+	owner() *Device
+}
+
+// Model is a discovery payload
+type Model interface {
+	setDefaults(id string, device *DeviceModel, stateTopic string)
+}
+
+// commandable models have a command topic
+type commandable interface {
+	commandModel() *CommandModel
+}
+
+// CommandHandler is called with the payload of a command from HASS.  It
+// runs on the MQTT client's goroutine, so should not block.
+type CommandHandler func(payload string)
+
+type entity struct {
+	device      *Device
+	id          string
+	component   string
+	configTopic string
+	stateTopic  string
+	model       Model
+	onCommand   CommandHandler
+}
+
+func newEntity(device *Device, component string, id string, model Model, stateTopic string, onCommand CommandHandler) (*entity, error) {
+	e := &entity{
+		device:      device,
+		id:          id,
+		component:   component,
+		configTopic: fmt.Sprintf("%s/%s/%s/%s/config", device.client.DiscoveryPrefix, component, device.client.id, id),
+		stateTopic:  stateTopic,
+		model:       model,
+		onCommand:   onCommand,
+	}
+
+	model.setDefaults(id, &device.model, stateTopic)
+	if cm, ok := model.(commandable); ok {
+		cm.commandModel().CommandTopic = device.CommandTopic(id)
+	}
+
+	err := e.Refresh()
+	if err != nil {
+		return nil, err
+	}
+
+	err = e.subscribe()
+	if err != nil {
+		return nil, err
+	}
+
+	device.client.addEntity(id, e)
+
+	return e, nil
+}
+
+func (e *entity) ID() string {
+	return e.id
+}
+
+func (e *entity) Component() string {
+	return e.component
+}
+
+func (e *entity) owner() *Device {
+	return e.device
+}
+
+func (e *entity) Refresh() error {
+	data, err := json.Marshal(e.model)
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("send: %s\n%s\n", e.configTopic, string(data))
+
+	return e.device.publish(&Message{Topic: e.configTopic, QOS: 1, Payload: data})
+}
+
+// Remove deletes the entity from Home Assistant with an empty (retained)
+// config, and stops refreshing it
+func (e *entity) Remove() error {
+	e.device.client.removeEntity(e.id)
+
+	if e.onCommand != nil {
+		e.device.client.unsubscribe(e.device.CommandTopic(e.id))
+	}
+
+	return e.device.publish(&Message{Topic: e.configTopic, QOS: 1, Retained: true})
+}
+
+func (e *entity) subscribe() error {
+	if e.onCommand == nil || !e.device.client.IsConnected() {
+		return nil
+	}
+
+	return e.device.client.subscribe(e.device.CommandTopic(e.id), e.onCommand)
+}
+
+// SendState publishes the state of an entity that has its own state topic
+func (e *entity) SendState(state interface{}) error {
+	if e.stateTopic == "" {
+		return fmt.Errorf("%s %s has no state topic", e.component, e.id)
+	}
+
+	return e.device.publish(&Message{Topic: e.stateTopic, Payload: payloadBytes(state), State: true})
+}
@@ -0,0 +1,66 @@
+package hassiomqtt
+
+import (
+	"fmt"
+)
+
+// Message is published to the broker
+type Message struct {
+	Topic    string
+	QOS      byte
+	Retained bool
+	Payload  []byte
+
+	// State messages are worthless once superseded, so with MQTT 5 they
+	// expire after the client's StateExpiry and are sent with a topic
+	// alias
+	State bool
+
+	// UserProperties are sent with MQTT 5 only
+	UserProperties map[string]string
+}
+
+// transport is a connection to the broker with one version of MQTT
+type transport interface {
+	// start connecting, retrying until connected, and calling onConnect on
+	// every connection
+	start(will *Message, onConnect func()) error
+
+	isConnected() bool
+
+	publish(m *Message) error
+
+	// subscribe calls onMessage with messages on a topic.  Shared
+	// subscriptions are handled by one of a group of clients, if the
+	// transport supports it.
+	subscribe(topic string, shared bool, onMessage func(payload []byte)) error
+
+	unsubscribe(topic string, shared bool) error
+}
+
+// ReasonCodeError is an MQTT 5 failure reported by the broker
+type ReasonCodeError struct {
+	Op     string
+	Code   byte
+	Reason string
+}
+
+func (e *ReasonCodeError) Error() string {
+	if e.Reason != "" {
+		return fmt.Sprintf("%s failed: reason code 0x%02x: %s", e.Op, e.Code, e.Reason)
+	}
+
+	return fmt.Sprintf("%s failed: reason code 0x%02x", e.Op, e.Code)
+}
+
+// payloadBytes converts the payloads accepted by publishing methods
+func payloadBytes(payload interface{}) []byte {
+	switch p := payload.(type) {
+	case []byte:
+		return p
+	case string:
+		return []byte(p)
+	}
+
+	return []byte(fmt.Sprint(payload))
+}
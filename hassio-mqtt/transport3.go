@@ -0,0 +1,88 @@
+package hassiomqtt
+
+import (
+	"crypto/tls"
+	"fmt"
+	"net/url"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+)
+
+const transport3RetryDelay = 5 * time.Second
+
+// transport3 uses MQTT 3.1.1
+type transport3 struct {
+	opts   *mqtt.ClientOptions
+	client mqtt.Client
+}
+
+func newTransport3(options *ClientOptions) *transport3 {
+	opts := mqtt.NewClientOptions()
+	for _, broker := range options.Brokers {
+		opts.AddBroker(broker)
+	}
+	opts.SetClientID(options.ClientID)
+	opts.SetUsername(options.User)
+	opts.SetPassword(options.Password)
+	opts.SetCleanSession(true)
+	opts.SetAutoReconnect(true)
+	if options.TLS != nil {
+		opts.SetTLSConfig(options.TLS)
+	}
+	opts.SetConnectionAttemptHandler(func(broker *url.URL, tlsCfg *tls.Config) *tls.Config {
+		fmt.Printf("connecting to MQTT broker %s\n", broker.Redacted())
+		return tlsCfg
+	})
+
+	return &transport3{opts: opts}
+}
+
+func (t *transport3) start(will *Message, onConnect func()) error {
+	t.opts.SetBinaryWill(will.Topic, will.Payload, will.QOS, will.Retained)
+	t.opts.SetOnConnectHandler(func(mqtt.Client) { onConnect() })
+	t.client = mqtt.NewClient(t.opts)
+
+	// Each attempt tries every broker in turn, each bounded by the connect
+	// timeout, so wait for it to finish before trying again.  Once
+	// connected, paho reconnects by itself.
+	go func() {
+		for {
+			tok := t.client.Connect()
+			tok.Wait()
+			err := tok.Error()
+			if err == nil {
+				return
+			}
+
+			fmt.Printf("error connecting to MQTT broker: %v\n", err)
+			time.Sleep(transport3RetryDelay)
+		}
+	}()
+
+	return nil
+}
+
+func (t *transport3) isConnected() bool {
+	return t.client != nil && t.client.IsConnected()
+}
+
+func (t *transport3) publish(m *Message) error {
+	tok := t.client.Publish(m.Topic, m.QOS, m.Retained, m.Payload)
+	tok.WaitTimeout(time.Second)
+	return tok.Error()
+}
+
+func (t *transport3) subscribe(topic string, shared bool, onMessage func(payload []byte)) error {
+	tok := t.client.Subscribe(topic, 1, func(cl mqtt.Client, m mqtt.Message) {
+		onMessage(m.Payload())
+	})
+	tok.WaitTimeout(time.Second)
+	return tok.Error()
+}
+
+func (t *transport3) unsubscribe(topic string, shared bool) error {
+	tok := t.client.Unsubscribe(topic)
+	tok.WaitTimeout(time.Second)
+	return tok.Error()
+}
@@ -0,0 +1,250 @@
+package hassiomqtt
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// testBroker is a stand-in MQTT 3.1.1 broker that accepts every
+// connection and records what clients send
+type testBroker struct {
+	listener     net.Listener
+	connackDelay time.Duration
+	connects     chan *packets.ConnectPacket
+	published    chan *packets.PublishPacket
+}
+
+func newTestBroker(t *testing.T, tlsConfig *tls.Config, connackDelay time.Duration) *testBroker {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tlsConfig != nil {
+		l = tls.NewListener(l, tlsConfig)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	b := &testBroker{
+		listener:     l,
+		connackDelay: connackDelay,
+		connects:     make(chan *packets.ConnectPacket, 10),
+		published:    make(chan *packets.PublishPacket, 100),
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+
+	return b
+}
+
+func (b *testBroker) addr() string {
+	return b.listener.Addr().String()
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		var reply packets.ControlPacket
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			b.connects <- p
+			time.Sleep(b.connackDelay)
+			reply = packets.NewControlPacket(packets.Connack)
+		case *packets.PublishPacket:
+			select {
+			case b.published <- p:
+			default:
+			}
+			if p.Qos == 1 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				reply = ack
+			}
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			ack.ReturnCodes = p.Qoss
+			reply = ack
+		case *packets.UnsubscribePacket:
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			reply = ack
+		case *packets.PingreqPacket:
+			reply = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			return
+		}
+
+		if reply != nil {
+			err = reply.Write(conn)
+			if err != nil {
+				return
+			}
+		}
+	}
+}
+
+// deadAddr gets an address nothing is listening on
+func deadAddr(t *testing.T) string {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+
+	return addr
+}
+
+// newTestCert creates a self-signed certificate for 127.0.0.1
+func newTestCert(t *testing.T, usage x509.ExtKeyUsage) (tls.Certificate, *x509.Certificate) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "zappy test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, cert
+}
+
+func TestTransport3Connect(t *testing.T) {
+	serverCert, serverX509 := newTestCert(t, x509.ExtKeyUsageServerAuth)
+	clientCert, clientX509 := newTestCert(t, x509.ExtKeyUsageClientAuth)
+
+	serverTLS := &tls.Config{
+		Certificates: []tls.Certificate{serverCert},
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		ClientCAs:    x509.NewCertPool(),
+	}
+	serverTLS.ClientCAs.AddCert(clientX509)
+
+	clientTLS := &tls.Config{
+		RootCAs:      x509.NewCertPool(),
+		Certificates: []tls.Certificate{clientCert},
+	}
+	clientTLS.RootCAs.AddCert(serverX509)
+
+	tests := []struct {
+		name         string
+		tls          bool
+		connackDelay time.Duration
+		dead         int
+	}{
+		{name: "tcp"},
+		{name: "failover", dead: 2},
+		{name: "slow handshake", connackDelay: 1500 * time.Millisecond},
+		{name: "tls failover", tls: true, dead: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scheme := "tcp://"
+			var brokerTLS *tls.Config
+			if tt.tls {
+				scheme = "ssl://"
+				brokerTLS = serverTLS
+			}
+
+			options := &ClientOptions{ClientID: "zappy"}
+			for i := 0; i < tt.dead; i++ {
+				options.Brokers = append(options.Brokers, scheme+deadAddr(t))
+			}
+			if tt.tls {
+				options.TLS = clientTLS
+			}
+
+			broker := newTestBroker(t, brokerTLS, tt.connackDelay)
+			options.Brokers = append(options.Brokers, scheme+broker.addr())
+
+			c, err := NewClient(options)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Start()
+			t.Cleanup(func() { c.transport.(*transport3).client.Disconnect(0) })
+
+			select {
+			case p := <-broker.connects:
+				if p.ClientIdentifier != "zappy" {
+					t.Errorf("client id %q", p.ClientIdentifier)
+				}
+				if !p.WillFlag || p.WillTopic != c.BridgeAvailabilityTopic() || string(p.WillMessage) != PayloadNotAvailable {
+					t.Errorf("will %v %q %q", p.WillFlag, p.WillTopic, p.WillMessage)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatal("timed out waiting to connect")
+			}
+
+			deadline := time.After(10 * time.Second)
+			for online := false; !online; {
+				select {
+				case p := <-broker.published:
+					online = p.TopicName == c.BridgeAvailabilityTopic() && string(p.Payload) == PayloadAvailable
+				case <-deadline:
+					t.Fatal("timed out waiting for availability")
+				}
+			}
+
+			if !c.IsConnected() {
+				t.Error("not connected")
+			}
+
+			// A single attempt is made however long it takes
+			select {
+			case <-broker.connects:
+				t.Error("connected more than once")
+			case <-time.After(500 * time.Millisecond):
+			}
+		})
+	}
+}
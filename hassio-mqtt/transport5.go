@@ -0,0 +1,258 @@
+package hassiomqtt
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.golang/autopaho"
+	"github.com/eclipse/paho.golang/paho"
+)
+
+const (
+	transport5Timeout = 5 * time.Second
+
+	// how long to wait for a connection when checking whether one is up
+	transport5UpCheck = 10 * time.Millisecond
+)
+
+// transport5 uses MQTT 5
+type transport5 struct {
+	cfg         autopaho.ClientConfig
+	sharedGroup string
+	stateExpiry time.Duration
+	conn        *autopaho.ConnectionManager
+
+	lock      sync.Mutex
+	connected bool
+	handlers  map[string]func(payload []byte)
+
+	// aliases of state topics on this connection, up to the broker's
+	// maximum, and whether the broker has been sent the topic of each
+	aliases    map[string]uint16
+	aliasesSet map[string]bool
+	aliasMax   uint16
+}
+
+func newTransport5(options *ClientOptions) (*transport5, error) {
+	t := &transport5{
+		sharedGroup: options.SharedGroup,
+		stateExpiry: options.StateExpiry,
+		handlers:    map[string]func(payload []byte){},
+	}
+
+	for _, broker := range options.Brokers {
+		u, err := url.Parse(broker)
+		if err != nil {
+			return nil, err
+		}
+		t.cfg.BrokerUrls = append(t.cfg.BrokerUrls, u)
+	}
+
+	t.cfg.TlsCfg = options.TLS
+	t.cfg.KeepAlive = 30
+	t.cfg.ConnectRetryDelay = 5 * time.Second
+	t.cfg.SetUsernamePassword(options.User, []byte(options.Password))
+	t.cfg.ClientID = options.ClientID
+	t.cfg.Router = paho.NewSingleHandlerRouter(t.route)
+
+	return t, nil
+}
+
+func (t *transport5) start(will *Message, onConnect func()) error {
+	t.cfg.SetWillMessage(will.Topic, will.Payload, will.QOS, will.Retained)
+
+	t.cfg.OnConnectionUp = func(cm *autopaho.ConnectionManager, ca *paho.Connack) {
+		t.lock.Lock()
+		t.connected = true
+		t.aliases = map[string]uint16{}
+		t.aliasesSet = map[string]bool{}
+		t.aliasMax = 0
+		if ca.Properties != nil && ca.Properties.TopicAliasMaximum != nil {
+			t.aliasMax = *ca.Properties.TopicAliasMaximum
+		}
+		t.lock.Unlock()
+
+		onConnect()
+	}
+	t.cfg.OnConnectError = func(err error) {
+		fmt.Printf("error connecting to MQTT broker: %v\n", err)
+	}
+	t.cfg.OnClientError = func(err error) {
+		t.connectionLost()
+		fmt.Printf("MQTT connection lost: %v\n", err)
+	}
+	t.cfg.OnServerDisconnect = func(d *paho.Disconnect) {
+		t.connectionLost()
+		reason := ""
+		if d.Properties != nil {
+			reason = d.Properties.ReasonString
+		}
+		fmt.Printf("MQTT broker disconnected: %v\n", &ReasonCodeError{Op: "connection", Code: d.ReasonCode, Reason: reason})
+	}
+
+	conn, err := autopaho.NewConnection(context.Background(), t.cfg)
+	if err != nil {
+		return err
+	}
+	t.conn = conn
+
+	return nil
+}
+
+// connectionLost clears the connected state unless the connection manager
+// has already reconnected.  The callbacks reporting a lost connection run
+// in their own goroutines, so may run after the next connection is up.
+func (t *transport5) connectionLost() {
+	ctx, cancel := context.WithTimeout(context.Background(), transport5UpCheck)
+	defer cancel()
+
+	if t.conn != nil && t.conn.AwaitConnection(ctx) == nil {
+		return
+	}
+
+	t.lock.Lock()
+	t.connected = false
+	t.lock.Unlock()
+}
+
+func (t *transport5) isConnected() bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	return t.connected
+}
+
+func (t *transport5) route(p *paho.Publish) {
+	t.lock.Lock()
+	fn := t.handlers[p.Topic]
+	t.lock.Unlock()
+
+	if fn != nil {
+		fn(p.Payload)
+	}
+}
+
+func (t *transport5) publish(m *Message) error {
+	p := &paho.Publish{
+		Topic:      m.Topic,
+		QoS:        m.QOS,
+		Retain:     m.Retained,
+		Payload:    m.Payload,
+		Properties: &paho.PublishProperties{},
+	}
+
+	for k, v := range m.UserProperties {
+		p.Properties.User.Add(k, v)
+	}
+
+	alias, aliasSet := uint16(0), false
+	if m.State {
+		if t.stateExpiry > 0 {
+			expiry := uint32(t.stateExpiry.Seconds())
+			p.Properties.MessageExpiry = &expiry
+		}
+
+		alias, aliasSet = t.alias(m.Topic)
+		if alias != 0 {
+			p.Properties.TopicAlias = &alias
+			if aliasSet {
+				p.Topic = ""
+			}
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), transport5Timeout)
+	defer cancel()
+
+	resp, err := t.conn.Publish(ctx, p)
+	if resp != nil && resp.ReasonCode >= 0x80 {
+		reason := ""
+		if resp.Properties != nil {
+			reason = resp.Properties.ReasonString
+		}
+		return &ReasonCodeError{Op: "publish to " + m.Topic, Code: resp.ReasonCode, Reason: reason}
+	}
+	if err != nil {
+		return err
+	}
+
+	if alias != 0 && !aliasSet {
+		t.lock.Lock()
+		if t.aliases[m.Topic] == alias {
+			t.aliasesSet[m.Topic] = true
+		}
+		t.lock.Unlock()
+	}
+
+	return nil
+}
+
+// alias gets the topic alias of a state topic on this connection, zero if
+// none are left, and whether the broker already knows it
+func (t *transport5) alias(topic string) (uint16, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	alias, ok := t.aliases[topic]
+	if !ok {
+		if len(t.aliases) >= int(t.aliasMax) {
+			return 0, false
+		}
+
+		alias = uint16(len(t.aliases) + 1)
+		t.aliases[topic] = alias
+	}
+
+	return alias, t.aliasesSet[topic]
+}
+
+func (t *transport5) filter(topic string, shared bool) string {
+	if shared && t.sharedGroup != "" {
+		return fmt.Sprintf("$share/%s/%s", t.sharedGroup, topic)
+	}
+
+	return topic
+}
+
+func (t *transport5) subscribe(topic string, shared bool, onMessage func(payload []byte)) error {
+	t.lock.Lock()
+	t.handlers[topic] = onMessage
+	t.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), transport5Timeout)
+	defer cancel()
+
+	filter := t.filter(topic, shared)
+	suback, err := t.conn.Subscribe(ctx, &paho.Subscribe{
+		Subscriptions: map[string]paho.SubscribeOptions{filter: {QoS: 1}},
+	})
+	if suback != nil && len(suback.Reasons) > 0 && suback.Reasons[0] >= 0x80 {
+		reason := ""
+		if suback.Properties != nil {
+			reason = suback.Properties.ReasonString
+		}
+		return &ReasonCodeError{Op: "subscribe to " + filter, Code: suback.Reasons[0], Reason: reason}
+	}
+
+	return err
+}
+
+func (t *transport5) unsubscribe(topic string, shared bool) error {
+	t.lock.Lock()
+	delete(t.handlers, topic)
+	t.lock.Unlock()
+
+	ctx, cancel := context.WithTimeout(context.Background(), transport5Timeout)
+	defer cancel()
+
+	filter := t.filter(topic, shared)
+	unsuback, err := t.conn.Unsubscribe(ctx, &paho.Unsubscribe{Topics: []string{filter}})
+	if unsuback != nil && len(unsuback.Reasons) > 0 && unsuback.Reasons[0] >= 0x80 {
+		return &ReasonCodeError{Op: "unsubscribe from " + filter, Code: unsuback.Reasons[0]}
+	}
+
+	return err
+}
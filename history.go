@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/netleapio/zappy-controller/tsdb"
+)
+
+const (
+	historyFlushPeriod = 1 * time.Minute
+	historyPrunePeriod = 1 * time.Hour
+)
+
+var defaultHistoryRetention = map[tsdb.Tier]time.Duration{
+	tsdb.TierMinute: 7 * 24 * time.Hour,
+	tsdb.TierHour:   365 * 24 * time.Hour,
+	tsdb.TierDay:    0,
+}
+
+type jsonHistorySeries struct {
+	DeviceID string
+	Sensor   string
+	Unit     string
+}
+
+type jsonHistoryBucket struct {
+	Time  time.Time
+	Min   float64
+	Max   float64
+	Mean  float64
+	Count uint32
+}
+
+// HistoryListener records every sensor reading in an embedded time-series
+// store and serves the rolled-up history over HTTP.
+type HistoryListener struct {
+	network      uint16
+	eventChannel chan DeviceChange
+	manager      *DeviceManager
+	store        *tsdb.Store
+
+	// receive time of the last sample appended to each series, as devices
+	// are notified again without new readings
+	recorded map[string]time.Time
+}
+
+func NewHistoryListener(cfg *HistorySettings) (*HistoryListener, error) {
+	store, err := tsdb.Open(cfg.Dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for tier, d := range defaultHistoryRetention {
+		store.SetRetention(tier, d)
+	}
+
+	for name, d := range cfg.Retention {
+		tier, err := tsdb.ParseTier(name)
+		if err != nil {
+			return nil, fmt.Errorf("history retention: %w", err)
+		}
+		store.SetRetention(tier, time.Duration(d))
+	}
+
+	return &HistoryListener{
+		eventChannel: make(chan DeviceChange, 10),
+		store:        store,
+		recorded:     map[string]time.Time{},
+	}, nil
+}
+
+func (l *HistoryListener) Init(manager *DeviceManager, network uint16) {
+	l.network = network
+	l.manager = manager
+}
+
+// RegisterAPI adds the history endpoints to the API
+func (l *HistoryListener) RegisterAPI(api *API) {
+	api.HandleFunc("/api/history", l.handleSeries)
+	api.HandleFunc("/api/history/", l.handleQuery)
+}
+
+func (l *HistoryListener) Start() {
+	go func() {
+		lastPrune := time.Time{}
+		for {
+			time.Sleep(historyFlushPeriod)
+			now := time.Now()
+
+			err := l.store.Flush(now)
+			if err != nil {
+				log.Printf("history: %v", err)
+			}
+
+			if now.Sub(lastPrune) >= historyPrunePeriod {
+				err = l.store.Prune(now)
+				if err != nil {
+					log.Printf("history: pruning: %v", err)
+				}
+				lastPrune = now
+			}
+		}
+	}()
+
+	go func() {
+		for {
+			change := <-l.eventChannel
+			d := l.manager.Snapshot(change.DeviceID)
+			if d != nil {
+				l.recordSensors(d)
+			}
+		}
+	}()
+}
+
+func (l *HistoryListener) recordSensors(d *DeviceState) {
+	for k, v := range d.sensors {
+		md := sensorMetadata[k]
+		if md == nil {
+			continue
+		}
+
+		// Only record readings that arrived in the latest report
+		if !v.Received.Equal(d.lastSeen) {
+			continue
+		}
+
+		name := historySeriesName(d.id, md.Name)
+		if !v.Received.After(l.recorded[name]) {
+			continue
+		}
+		l.recorded[name] = v.Received
+
+		err := l.store.Append(name, v.Received, v.Value)
+		if err != nil {
+			log.Printf("history: device #%04x %s: %v", d.id, md.Name, err)
+		}
+	}
+}
+
+// handleSeries lists the recorded series
+func (l *HistoryListener) handleSeries(w http.ResponseWriter, r *http.Request) {
+	names, err := l.store.Series()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	result := []jsonHistorySeries{}
+	for _, name := range names {
+		device, sensor, ok := strings.Cut(name, ".")
+		if !ok {
+			continue
+		}
+
+		series := jsonHistorySeries{DeviceID: device, Sensor: sensor}
+		if t, ok := sensorTypeByName(sensor); ok {
+			series.Unit = string(l.manager.Units().Unit(sensorMetadata[t]))
+		}
+
+		result = append(result, series)
+	}
+
+	writeJSON(w, result)
+}
+
+// handleQuery serves /api/history/{device}/{sensor}?from=&to=&resolution=
+//
+// 'from' and 'to' are RFC3339 times defaulting to the last 24 hours, and
+// 'resolution' is one of the rollup tiers, chosen from the time span if
+// not given.  Values are in the configured output units.
+func (l *HistoryListener) handleQuery(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/api/history/"), "/")
+	if len(parts) != 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	id, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		http.Error(w, "invalid device id", http.StatusBadRequest)
+		return
+	}
+
+	q := r.URL.Query()
+
+	to := time.Time{}
+	if s := q.Get("to"); s != "" {
+		to, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "invalid 'to' time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	from := time.Now().Add(-24 * time.Hour)
+	if s := q.Get("from"); s != "" {
+		from, err = time.Parse(time.RFC3339, s)
+		if err != nil {
+			http.Error(w, "invalid 'from' time", http.StatusBadRequest)
+			return
+		}
+	}
+
+	tier := historyTierForSpan(from, to)
+	if s := q.Get("resolution"); s != "" {
+		tier, err = tsdb.ParseTier(s)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	t, ok := sensorTypeByName(parts[1])
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+	md := sensorMetadata[t]
+
+	buckets, err := l.store.Query(historySeriesName(uint16(id), md.Name), tier, from, to)
+	if errors.Is(err, tsdb.ErrNotFound) {
+		http.NotFound(w, r)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Values are stored in base units, so convert to output units
+	units := l.manager.Units()
+	result := make([]jsonHistoryBucket, 0, len(buckets))
+	for _, b := range buckets {
+		result = append(result, jsonHistoryBucket{
+			Time:  b.Start,
+			Min:   units.Quantity(md, b.Min).Value,
+			Max:   units.Quantity(md, b.Max).Value,
+			Mean:  units.Quantity(md, b.Mean()).Value,
+			Count: b.Count,
+		})
+	}
+
+	writeJSON(w, result)
+}
+
+func historySeriesName(id uint16, sensor string) string {
+	return fmt.Sprintf("%d.%s", id, sensor)
+}
+
+func historyTierForSpan(from time.Time, to time.Time) tsdb.Tier {
+	if to.IsZero() {
+		to = time.Now()
+	}
+
+	span := to.Sub(from)
+	switch {
+	case span <= 2*24*time.Hour:
+		return tsdb.TierMinute
+	case span <= 90*24*time.Hour:
+		return tsdb.TierHour
+	default:
+		return tsdb.TierDay
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"log"
 	"os"
 	"strings"
+	"time"
 
 	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/netleapio/zappy-framework/protocol"
@@ -28,28 +29,73 @@ func mainImpl(port string) error {
 		return fmt.Errorf("error loading config: %w", err)
 	}
 
-	mgr := NewDeviceManager()
+	mgr, err := NewDeviceManager(cfg)
+	if err != nil {
+		return fmt.Errorf("error in config: %w", err)
+	}
 
 	metrics := NewPrometheusListener()
 	metrics.Init(mgr, NetworkID)
 	mgr.AddListener(metrics.eventChannel)
 
+	// Outputs that publish device state do so through the gate
+	gate, err := NewPublishGate(&cfg.Publish)
+	if err != nil {
+		return fmt.Errorf("error in publish settings: %w", err)
+	}
+	gate.Init(mgr, NetworkID)
+	mgr.AddListener(gate.eventChannel)
+	metrics.Register(gate)
+
 	websocket := NewWebSocketListener()
 	websocket.Init(mgr, NetworkID)
-	mgr.AddListener(websocket.eventChannel)
+	gate.AddListener(websocket.eventChannel)
+
+	downlink := NewDownlink(NetworkID, &cfg.Downlink, mgr.Events())
 
-	mqttBroker := NewMQTTListener(&cfg.Mqtt)
+	mqttBroker, err := NewMQTTListener(&cfg.Mqtt, downlink)
+	if err != nil {
+		return fmt.Errorf("error in mqtt settings: %w", err)
+	}
 	mqttBroker.Init(mgr, NetworkID)
-	mgr.AddListener(mqttBroker.eventChannel)
+	gate.AddListener(mqttBroker.eventChannel)
+
+	rules, err := NewRulesEngine(&cfg.Rules, downlink, mqttBroker.Publish)
+	if err != nil {
+		return fmt.Errorf("error in rules: %w", err)
+	}
+	rules.Init(mgr, NetworkID)
+	mgr.AddListener(rules.eventChannel)
+
+	var history *HistoryListener
+	if cfg.History.Dir != "" {
+		history, err = NewHistoryListener(&cfg.History)
+		if err != nil {
+			return fmt.Errorf("error opening history: %w", err)
+		}
+		history.Init(mgr, NetworkID)
+		mgr.AddListener(history.eventChannel)
+		history.Start()
+	}
 
 	mqtt.ERROR = log.New(os.Stdout, "[ERROR] ", 0)
 	mqtt.CRITICAL = log.New(os.Stdout, "[CRIT] ", 0)
 	mqtt.WARN = log.New(os.Stdout, "[WARN]  ", 0)
 	mqtt.DEBUG = log.New(os.Stdout, "[DEBUG] ", 0)
 
+	api := NewAPI(&cfg.API, mgr, downlink)
+	gate.RegisterAPI(api)
+	rules.RegisterAPI(api)
+	if history != nil {
+		history.RegisterAPI(api)
+	}
+	api.Start()
+
+	gate.Start()
 	websocket.Start()
 	metrics.Start()
 	mqttBroker.Start()
+	rules.Start()
 	mgr.Start()
 
 	radio := radio{}
@@ -58,19 +104,23 @@ func mainImpl(port string) error {
 		return fmt.Errorf("failed to open serial port '%s': %v", port, err)
 	}
 	defer radio.Close()
+	mgr.Controller().SetRadioConnected(true)
 
 	pkt := protocol.Packet{}
+	txPkt := protocol.Packet{}
 
 	for {
 		pkt.SetLength(255)
 		n, err := radio.Rx(1000*120, pkt.AsBytes())
 		if err != nil {
+			mgr.Controller().SetRadioConnected(false)
 			return err
 		}
 		pkt.SetLength(uint8(n))
 		if n == 0 {
 			continue
 		}
+		mgr.Controller().Received(time.Now())
 
 		log.Println("received:")
 		log.Println(hex.Dump(pkt.AsBytes()))
@@ -87,6 +137,12 @@ func mainImpl(port string) error {
 			continue
 		}
 
+		if !pkt.CRCValid() {
+			log.Printf("Device #%04x: bad CRC, skipping", pkt.DeviceID())
+			mgr.DecodeFailure(pkt.DeviceID())
+			continue
+		}
+
 		log.Printf("Network: 0x%04x\n", pkt.NetworkID())
 		log.Printf("Device: 0x%04x\n", pkt.DeviceID())
 		log.Printf("Version: %d\n", pkt.Version())
@@ -96,34 +152,28 @@ func mainImpl(port string) error {
 		switch msg.Packet().Type() {
 		case protocol.TypeSensorReport:
 			rpt := msg.(*protocol.SensorReport)
-			if rpt.HasBatteryVoltage() {
-				log.Printf("Batt: %.3f V\n", float32(rpt.BatteryVoltage())/1000)
-			}
-			if rpt.HasTemperature() {
-				log.Printf("Temp: %.2f C\n", float32(rpt.Temperature())/100)
-			}
-			if rpt.HasPressure() {
-				log.Printf("Pressure: %.1f mbar\n", float32(rpt.Pressure())/10)
-			}
-			if rpt.HasHumidity() {
-				log.Printf("Humidity: %.2f %%\n", float32(rpt.Humidity())/100)
-			}
-			if rpt.HasSupplyVoltage() {
-				log.Printf("Supply: %.2f V\n", float32(rpt.SupplyVoltage())/1000)
-			}
-			if rpt.HasLoadPower() {
-				log.Printf("Load Power: %.2f W\n", float32(rpt.LoadPower())/10)
-			}
-			if rpt.HasCoils() {
-				log.Printf("Coils: %X W\n", rpt.Coils())
+			for t, v := range rpt.AllReadings() {
+				md := sensorMetadata[t]
+				if md == nil {
+					log.Printf("Unknown sensor #%d: %d\n", t, v)
+					continue
+				}
+				log.Printf("%s: %s\n", md.Name, mgr.Units().Quantity(md, sensorValue(md, v)))
 			}
 			mgr.DeviceSensorUpdate(rpt)
+
+			// The device listens briefly after reporting, so send any
+			// queued commands now
+			if cmds, ok := downlink.Take(pkt.DeviceID(), &txPkt); ok {
+				downlink.Sent(pkt.DeviceID(), cmds, radio.Tx(txPkt.AsBytes()))
+			}
 		}
 	}
 }
 
 func main() {
 	port := flag.String("port", "", "port to use for dongle")
+	api := flag.String("api", DefaultAPIAddress, "address of a running controller, for management commands")
 
 	flag.Parse()
 
@@ -155,8 +205,14 @@ func main() {
 			}
 		}
 	default:
-		flag.Usage()
-		os.Exit(1)
+		ok, err := runCLI(*api, cmd, flag.Args()[1:])
+		if err != nil {
+			exitOnError(err)
+		}
+		if !ok {
+			flag.Usage()
+			os.Exit(1)
+		}
 	}
 }
 
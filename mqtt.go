@@ -1,51 +1,199 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"strings"
+	"log"
+	"net/url"
+	"os"
+	"time"
 
 	hassiomqtt "github.com/netleapio/zappy-controller/hassio-mqtt"
 	"github.com/netleapio/zappy-framework/protocol"
 )
 
-var hassSensorMetadata = map[protocol.SensorType]struct {
-	deviceClass string
-	units       string
-	icon        *string
-}{
-	protocol.SensorTypeTemperature: {deviceClass: "temperature", units: "°C"},
-	protocol.SensorTypeHumidity:    {deviceClass: "humidity", units: "%"},
-	protocol.SensorTypePressure:    {deviceClass: "atmospheric_pressure", units: "Pa"},
-	protocol.SensorTypeBattVolts:   {deviceClass: "voltage", units: "V"},
-	protocol.SensorTypeSupplyVolts: {deviceClass: "voltage", units: "V"},
-	protocol.SensorTypeLoadPower:   {deviceClass: "power", units: "W"},
+// hassDeviceClasses maps the sensor types published to Home Assistant to
+// their device class.  Icons and categories come from device profiles.
+var hassDeviceClasses = map[protocol.SensorType]string{
+	protocol.SensorTypeTemperature: "temperature",
+	protocol.SensorTypeHumidity:    "humidity",
+	protocol.SensorTypePressure:    "atmospheric_pressure",
+	protocol.SensorTypeBattVolts:   "voltage",
+	protocol.SensorTypeSupplyVolts: "voltage",
+	protocol.SensorTypeLoadPower:   "power",
+	SensorTypeDewPoint:             "temperature",
+	SensorTypeAbsoluteHumidity:     "",
+	SensorTypeHeatIndex:            "temperature",
+	SensorTypeSeaLevelPressure:     "atmospheric_pressure",
+	SensorTypeZoneTemperatureMean:  "temperature",
+	SensorTypeZoneTemperatureMin:   "temperature",
+	SensorTypeZoneTemperatureMax:   "temperature",
+	SensorTypeZoneHumidityMax:      "humidity",
+	SensorTypeZoneAnyAlert:         "",
+	SensorTypeBatteryLevel:         "battery",
+	SensorTypeBatteryDaysRemaining: "duration",
+	SensorTypePacketLoss:           "",
+	SensorTypeReportInterval:       "duration",
+	SensorTypeReportJitter:         "duration",
 }
 
 type mqttDevice struct {
 	hassDevice   *hassiomqtt.Device
 	hassEntities map[protocol.SensorType]*hassiomqtt.Sensor
+	entityIds    map[protocol.SensorType]string
+	available    map[protocol.SensorType]bool
+
+	// controls are the entities for commands, by command
+	controls map[string]hassiomqtt.Entity
+
+	// diagnostics are the entities about the device's link, by name
+	diagnostics map[string]hassiomqtt.Entity
+
+	alertSensors  map[protocol.Alerts]*hassiomqtt.BinarySensor
+	alertTriggers map[string]*hassiomqtt.DeviceTrigger
+
+	// alerts last published, nil if not yet
+	alerts *protocol.Alerts
+
+	// online is the published availability of the whole device, nil if
+	// not yet published
+	online *bool
 }
 
 type MQTTListener struct {
 	network      uint16
 	eventChannel chan DeviceChange
+	refresh      chan struct{}
 	mqtt         *hassiomqtt.Client
 	manager      *DeviceManager
-	devices      map[uint16]mqttDevice
+	downlink     *Downlink
+	auth         *commandAuth
+	devices      map[uint16]*mqttDevice
+
+	// actions run on the loop on behalf of command handlers, which run on
+	// the MQTT client's goroutine
+	actions chan func()
+
+	// hub is the controller itself, linked to devices with via_device
+	hub         *hassiomqtt.Device
+	hubEntities map[string]hassiomqtt.Entity
 }
 
-func NewMQTTListener(cfg *MQTTSettings) *MQTTListener {
+func NewMQTTListener(cfg *MQTTSettings, downlink *Downlink) (*MQTTListener, error) {
+	auth, err := newCommandAuth(&cfg.Commands)
+	if err != nil {
+		return nil, err
+	}
+
+	options, err := mqttClientOptions(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	client, err := hassiomqtt.NewClient(options)
+	if err != nil {
+		return nil, err
+	}
+
 	listener := &MQTTListener{
 		eventChannel: make(chan DeviceChange, 10),
-		mqtt:         hassiomqtt.NewClient(cfg.Broker, cfg.Port, cfg.ClientID, cfg.User, cfg.Password),
-		devices:      map[uint16]mqttDevice{},
+		refresh:      make(chan struct{}, 1),
+		mqtt:         client,
+		downlink:     downlink,
+		auth:         auth,
+		devices:      map[uint16]*mqttDevice{},
+		actions:      make(chan func(), 10),
+		hubEntities:  map[string]hassiomqtt.Entity{},
 	}
 
 	if cfg.DiscoveryPrefix != "" {
 		listener.mqtt.DiscoveryPrefix = cfg.DiscoveryPrefix
 	}
 
-	return listener
+	return listener, nil
+}
+
+// mqttBrokerSchemes are the broker URL schemes supported
+var mqttBrokerSchemes = map[string]bool{"tcp": true, "ssl": true, "ws": true, "wss": true}
+
+// mqttClientOptions gets the broker connection options from settings
+func mqttClientOptions(cfg *MQTTSettings) (*hassiomqtt.ClientOptions, error) {
+	options := &hassiomqtt.ClientOptions{
+		Brokers:     cfg.Brokers,
+		ClientID:    cfg.ClientID,
+		User:        cfg.User,
+		Password:    cfg.Password,
+		Version:     cfg.Version,
+		SharedGroup: cfg.SharedGroup,
+		StateExpiry: time.Duration(cfg.StateExpiry),
+	}
+
+	switch cfg.Version {
+	case 0, 3:
+		if cfg.SharedGroup != "" || cfg.StateExpiry != 0 {
+			return nil, errors.New("sharedGroup and stateExpiry need MQTT version 5")
+		}
+	case 5:
+	default:
+		return nil, fmt.Errorf("unsupported MQTT version %d", cfg.Version)
+	}
+
+	if len(options.Brokers) == 0 {
+		options.Brokers = []string{fmt.Sprintf("tcp://%s:%d", cfg.Broker, cfg.Port)}
+	}
+
+	secure := false
+	for _, broker := range options.Brokers {
+		u, err := url.Parse(broker)
+		if err != nil {
+			return nil, fmt.Errorf("broker '%s': %w", broker, err)
+		}
+		if !mqttBrokerSchemes[u.Scheme] {
+			return nil, fmt.Errorf("broker '%s': unsupported scheme '%s'", broker, u.Scheme)
+		}
+		secure = secure || u.Scheme == "ssl" || u.Scheme == "wss"
+	}
+
+	t := &cfg.TLS
+	if !secure {
+		if t.CA != "" || t.Cert != "" || t.Key != "" || t.InsecureSkipVerify {
+			return nil, errors.New("tls settings need an ssl:// or wss:// broker")
+		}
+		return options, nil
+	}
+
+	options.TLS = &tls.Config{InsecureSkipVerify: t.InsecureSkipVerify}
+	if t.InsecureSkipVerify {
+		log.Printf("MQTT: not verifying broker certificates")
+	}
+
+	if t.CA != "" {
+		pem, err := os.ReadFile(t.CA)
+		if err != nil {
+			return nil, fmt.Errorf("tls ca: %w", err)
+		}
+
+		options.TLS.RootCAs = x509.NewCertPool()
+		if !options.TLS.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("tls ca: no certificates in '%s'", t.CA)
+		}
+	}
+
+	if (t.Cert == "") != (t.Key == "") {
+		return nil, errors.New("tls cert and key must be set together")
+	}
+	if t.Cert != "" {
+		cert, err := tls.LoadX509KeyPair(t.Cert, t.Key)
+		if err != nil {
+			return nil, fmt.Errorf("tls client certificate: %w", err)
+		}
+		options.TLS.Certificates = []tls.Certificate{cert}
+	}
+
+	return options, nil
 }
 
 func (l *MQTTListener) Init(manager *DeviceManager, network uint16) {
@@ -54,89 +202,260 @@ func (l *MQTTListener) Init(manager *DeviceManager, network uint16) {
 }
 
 func (l *MQTTListener) Start() {
+	// Availability and state must be republished along with discovery
+	// config, but devices are only touched by the loop below
+	l.mqtt.AddOnRefresh(func() {
+		select {
+		case l.refresh <- struct{}{}:
+		default:
+		}
+	})
+
+	if len(l.auth.controller) > 0 {
+		l.mqtt.Subscribe(l.mqtt.CommandTopic(), l.handleControllerCommand)
+	}
+
 	l.mqtt.Start()
 
 	go func() {
+		ticker := time.NewTicker(hubUpdatePeriod)
 		for {
-			change := <-l.eventChannel
-
-			if !l.mqtt.Client.IsConnected() {
+			var change DeviceChange
+			select {
+			case change = <-l.eventChannel:
+			case now := <-ticker.C:
+				l.updateHub(now)
+				continue
+			case <-l.refresh:
+				l.republish()
+				continue
+			case action := <-l.actions:
+				action()
 				continue
 			}
 
-			d := l.manager.GetDevice(change.DeviceID)
-			if d == nil {
-				l.removeDevice(change.DeviceID)
+			// Changes missed while disconnected are caught up by
+			// republish once reconnected
+			if !l.mqtt.IsConnected() || change.Changes&ChangeDevicePending != 0 {
 				continue
-			} else if change.Changes&ChangeNewDevice != 0 {
-				l.newDevice(d)
 			}
 
-			l.updateSensorStats(d)
+			if change.Changes&ChangeDeviceRemoved != 0 {
+				l.removeDevice(change.DeviceID)
+			} else {
+				l.updateDevice(change.DeviceID)
+			}
 		}
 	}()
 }
 
-func (l *MQTTListener) newDevice(d *DeviceState) {
-	println("new device")
+// updateDevice reconciles a device's entities and publishes its state
+func (l *MQTTListener) updateDevice(id uint16) {
+	d := l.manager.Snapshot(id)
+	if d == nil {
+		// Gone for now, but may return
+		l.markUnavailable(id)
+		return
+	}
+
+	if l.reconcile(d) != nil {
+		l.updateSensorStats(d)
+	}
+}
+
+// Publish sends a message to the broker, failing if not connected
+func (l *MQTTListener) Publish(topic string, payload string) error {
+	return l.mqtt.Publish(&hassiomqtt.Message{Topic: topic, QOS: 1, Payload: []byte(payload)})
+}
+
+// reconcile creates entities for readings a device has that are not yet
+// published, and removes those for readings it no longer has
+func (l *MQTTListener) reconcile(d *DeviceState) *mqttDevice {
+	profile := l.manager.Profile(d.id)
+	if profile == nil {
+		return nil
+	}
+
 	dev, ok := l.devices[d.id]
 	if !ok {
-		deviceId := fmt.Sprintf("zappy_%d_%d", l.network, d.id)
-		deviceName := fmt.Sprintf("Zappy Environment Sensor #%d", d.id)
-
-		dev = mqttDevice{
+		dev = &mqttDevice{
 			hassDevice: hassiomqtt.NewDevice(l.mqtt, fmt.Sprintf("%d", d.id), &hassiomqtt.DeviceModel{
-				Identifiers:  []string{deviceId},
-				Manufacturer: "Zappy",
-				Model:        "Zappy Environment Sensor",
-				Name:         deviceName,
+				Identifiers:  []string{l.deviceId(d.id)},
+				Manufacturer: profile.Manufacturer,
+				Model:        profile.Model,
+				Name:         l.manager.DeviceName(d.id),
 				SerialNumber: fmt.Sprintf("%d", d.id),
+				ViaDevice:    l.hubId(),
 			}),
 			hassEntities: map[protocol.SensorType]*hassiomqtt.Sensor{},
+			entityIds:    map[protocol.SensorType]string{},
+			available:    map[protocol.SensorType]bool{},
+			controls:     map[string]hassiomqtt.Entity{},
+			diagnostics:  map[string]hassiomqtt.Entity{},
+
+			alertSensors:  map[protocol.Alerts]*hassiomqtt.BinarySensor{},
+			alertTriggers: map[string]*hassiomqtt.DeviceTrigger{},
 		}
+		l.devices[d.id] = dev
+	}
 
-		for t, _ := range d.sensors {
-			md, ok := protocol.SensorMetadata[t]
-			if !ok {
-				continue
-			}
+	for t := range d.sensors {
+		if _, ok := dev.hassEntities[t]; !ok {
+			l.addEntity(dev, d.id, t, profile)
+		}
+	}
 
-			hassMd, ok := hassSensorMetadata[t]
-			if !ok {
-				continue
-			}
+	for t := range dev.hassEntities {
+		if _, ok := d.sensors[t]; !ok {
+			l.removeEntity(dev, t)
+		}
+	}
 
-			_, ok = dev.hassEntities[t]
-			if !ok {
-
-				sensorId := fmt.Sprintf("%s_%s", deviceId, md.Name)
-
-				s, err := hassiomqtt.NewSensor(dev.hassDevice, "sensor", sensorId,
-					&hassiomqtt.SensorModel{
-						EntityModel: hassiomqtt.EntityModel{
-							DeviceClass:   hassMd.deviceClass,
-							Name:          md.Name,
-							ObjectID:      fmt.Sprintf("%s_%s", deviceId, hassMd.deviceClass),
-							ValueTemplate: fmt.Sprintf("{{value_json.%s}}", md.Name),
-						},
-						SuggestedDisplayPrecision: 2,
-						UnitOfMeasurement:         hassMd.units,
-					})
-				if err != nil {
-					continue
-				}
-				dev.hassEntities[t] = s
-
-				l.devices[d.id] = dev
-			}
+	l.addAlertEntities(dev, d.id)
+	l.addDiagnostics(dev, d)
+	l.addControls(dev, d)
 
-		}
+	return dev
+}
+
+func (l *MQTTListener) deviceId(id uint16) string {
+	return fmt.Sprintf("zappy_%d_%d", l.network, id)
+}
+
+// addEntity publishes discovery config for one reading of a device
+func (l *MQTTListener) addEntity(dev *mqttDevice, id uint16, t protocol.SensorType, profile *DeviceProfile) {
+	md, ok := sensorMetadata[t]
+	if !ok {
+		return
+	}
+
+	deviceClass, ok := hassDeviceClasses[t]
+	if !ok {
+		return
+	}
+
+	deviceId := l.deviceId(id)
+	sensorId := fmt.Sprintf("%s_%s", deviceId, md.Name)
+
+	sp := profile.Sensor(t)
+	category := ""
+	if sp.Diagnostic {
+		category = "diagnostic"
+	}
+
+	var enabled *bool
+	if sp.Disabled {
+		enabled = new(bool)
 	}
 
-	l.updateSensorStats(d)
+	unit := l.manager.Units().Unit(md)
+
+	s, err := hassiomqtt.NewSensor(dev.hassDevice, sensorId,
+		&hassiomqtt.SensorModel{
+			EntityModel: hassiomqtt.EntityModel{
+				Availability:     dev.hassDevice.Availability(sensorId),
+				AvailabilityMode: "all",
+				DeviceClass:      deviceClass,
+				EnabledByDefault: enabled,
+				EntityCategory:   category,
+				Icon:             sp.Icon,
+				Name:             md.Name,
+				ObjectID:         sensorId,
+				ValueTemplate:    fmt.Sprintf("{{value_json.%s}}", md.Name),
+			},
+			SuggestedDisplayPrecision: profile.Precision(t, unit),
+			UnitOfMeasurement:         string(unit),
+		})
+	if err != nil {
+		return
+	}
+
+	dev.hassEntities[t] = s
+	dev.entityIds[t] = sensorId
 }
 
+// removeEntity deletes one reading of a device from Home Assistant
+func (l *MQTTListener) removeEntity(dev *mqttDevice, t protocol.SensorType) {
+	err := dev.hassEntities[t].Remove()
+	if err != nil {
+		log.Printf("failed to remove entity %s: %v", dev.entityIds[t], err)
+	}
+	dev.hassDevice.ClearAvailability(dev.entityIds[t])
+
+	delete(dev.hassEntities, t)
+	delete(dev.entityIds, t)
+	delete(dev.available, t)
+}
+
+// removeDevice deletes a forgotten device's entities from Home Assistant
 func (l *MQTTListener) removeDevice(id uint16) {
+	dev, ok := l.devices[id]
+	if !ok {
+		return
+	}
+
+	for t := range dev.hassEntities {
+		l.removeEntity(dev, t)
+	}
+	l.removeAlertEntities(dev)
+	l.removeDiagnostics(dev)
+	l.removeControls(dev)
+
+	delete(l.devices, id)
+}
+
+// markUnavailable marks a device that has gone as unavailable
+func (l *MQTTListener) markUnavailable(id uint16) {
+	dev, ok := l.devices[id]
+	if !ok {
+		return
+	}
+
+	l.setOnline(dev, false)
+}
+
+// setOnline publishes the availability of a whole device when it changes
+func (l *MQTTListener) setOnline(dev *mqttDevice, online bool) {
+	if dev.online != nil && *dev.online == online {
+		return
+	}
+
+	if dev.hassDevice.SendDeviceAvailability(online) == nil {
+		dev.online = &online
+	}
+}
+
+// republish sends the availability and state of every device again,
+// after a reconnect or Home Assistant restart
+func (l *MQTTListener) republish() {
+	if !l.mqtt.IsConnected() {
+		return
+	}
+
+	l.addHub()
+	l.updateHub(time.Now())
+
+	for id, dev := range l.devices {
+		dev.online = nil
+		dev.available = map[protocol.SensorType]bool{}
+
+		if l.manager.Snapshot(id) != nil {
+			continue
+		}
+
+		// Forgotten devices have no traffic history, unlike those that
+		// have only timed out
+		if _, ok := l.manager.TrafficStats(id); ok {
+			l.markUnavailable(id)
+		} else {
+			l.removeDevice(id)
+		}
+	}
+
+	// Including devices discovered while disconnected
+	for _, id := range l.manager.DeviceIDs() {
+		l.updateDevice(id)
+	}
 }
 
 func (l *MQTTListener) updateSensorStats(d *DeviceState) {
@@ -147,21 +466,48 @@ func (l *MQTTListener) updateSensorStats(d *DeviceState) {
 		return
 	}
 
-	sb := strings.Builder{}
-	sb.WriteString("{")
-	prefix := ""
+	status := map[string]interface{}{}
 	for t, v := range d.sensors {
-		md, ok := protocol.SensorMetadata[t]
-		if !ok {
+		md, ok := sensorMetadata[t]
+		if !ok || v.Stale {
 			continue
 		}
 
-		value := (float32(v) * float32(md.Mult)) / float32(md.Div)
+		status[md.Name] = l.manager.Units().Quantity(md, v.Value).Value
+	}
+	alertStatus(status, d.alerts)
+	l.diagnosticStatus(status, d)
 
-		sb.WriteString(fmt.Sprintf("%s\"%s\":%v", prefix, md.Name, value))
-		prefix = ","
+	data, err := json.Marshal(status)
+	if err != nil {
+		log.Printf("Device #%04x: failed to encode status: %v", d.id, err)
+		return
 	}
-	sb.WriteString("}")
 
-	dev.hassDevice.SendStatus(sb.String())
+	dev.hassDevice.SendStatus(string(data))
+	l.fireAlertTriggers(dev, d)
+
+	l.setOnline(dev, true)
+	l.updateAvailability(d, dev)
+	l.updateControls(dev, d)
+}
+
+// updateAvailability marks entities unavailable while their reading is
+// stale, publishing only when availability changes
+func (l *MQTTListener) updateAvailability(d *DeviceState, dev *mqttDevice) {
+	for t, id := range dev.entityIds {
+		r, ok := d.sensors[t]
+		available := ok && !r.Stale
+
+		prev, published := dev.available[t]
+		if published && prev == available {
+			continue
+		}
+
+		err := dev.hassDevice.SendAvailability(id, available)
+		if err != nil {
+			continue
+		}
+		dev.available[t] = available
+	}
 }
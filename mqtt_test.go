@@ -0,0 +1,335 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang/packets"
+)
+
+// testBroker is a stand-in MQTT 3.1.1 broker that keeps the last payload
+// published to each topic
+type testBroker struct {
+	listener net.Listener
+
+	lock     sync.Mutex
+	payloads map[string]string
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	t.Helper()
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+
+	b := &testBroker{listener: l, payloads: map[string]string{}}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go b.serve(conn)
+		}
+	}()
+
+	return b
+}
+
+func (b *testBroker) url() string {
+	return "tcp://" + b.listener.Addr().String()
+}
+
+func (b *testBroker) serve(conn net.Conn) {
+	defer conn.Close()
+
+	for {
+		cp, err := packets.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+
+		var reply packets.ControlPacket
+		switch p := cp.(type) {
+		case *packets.ConnectPacket:
+			reply = packets.NewControlPacket(packets.Connack)
+		case *packets.PublishPacket:
+			b.lock.Lock()
+			b.payloads[p.TopicName] = string(p.Payload)
+			b.lock.Unlock()
+			if p.Qos == 1 {
+				ack := packets.NewControlPacket(packets.Puback).(*packets.PubackPacket)
+				ack.MessageID = p.MessageID
+				reply = ack
+			}
+		case *packets.SubscribePacket:
+			ack := packets.NewControlPacket(packets.Suback).(*packets.SubackPacket)
+			ack.MessageID = p.MessageID
+			ack.ReturnCodes = p.Qoss
+			reply = ack
+		case *packets.UnsubscribePacket:
+			ack := packets.NewControlPacket(packets.Unsuback).(*packets.UnsubackPacket)
+			ack.MessageID = p.MessageID
+			reply = ack
+		case *packets.PingreqPacket:
+			reply = packets.NewControlPacket(packets.Pingresp)
+		case *packets.DisconnectPacket:
+			return
+		}
+
+		if reply != nil && reply.Write(conn) != nil {
+			return
+		}
+	}
+}
+
+// configs gets the discovery configs published for entities whose IDs
+// contain a string, by topic
+func (b *testBroker) configs(contains string) map[string]string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	result := map[string]string{}
+	for topic, payload := range b.payloads {
+		if strings.HasSuffix(topic, "/config") && strings.Contains(topic, contains) {
+			result[topic] = payload
+		}
+	}
+
+	return result
+}
+
+// waitFor polls a condition until it holds or times out
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+// newTestMQTT starts a device manager and MQTT listener connected to a
+// stand-in broker
+func newTestMQTT(t *testing.T, cfg *Config) (*DeviceManager, *MQTTListener, *testBroker) {
+	t.Helper()
+
+	cfg.Registry = filepath.Join(t.TempDir(), "registry.json")
+	mgr, err := NewDeviceManager(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	broker := newTestBroker(t)
+	l, err := NewMQTTListener(&MQTTSettings{Brokers: []string{broker.url()}, ClientID: "zappy"}, NewDownlink(NetworkID, &cfg.Downlink, mgr.Events()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Init(mgr, NetworkID)
+	mgr.AddListener(l.eventChannel)
+	l.Start()
+
+	waitFor(t, "connection", l.mqtt.IsConnected)
+
+	return mgr, l, broker
+}
+
+// writeTestCert writes a self-signed certificate and its key as PEM files
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "zappy test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certFile := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	err = os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644)
+	if err == nil {
+		err = os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return certFile, keyFile
+}
+
+func TestMQTTClientOptions(t *testing.T) {
+	dir := t.TempDir()
+	cert, key := writeTestCert(t, dir)
+
+	notPEM := filepath.Join(dir, "empty.pem")
+	err := os.WriteFile(notPEM, []byte("not a certificate\n"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		cfg     MQTTSettings
+		brokers []string
+		tls     bool
+		certs   int
+		err     string
+	}{
+		{
+			name:    "broker and port",
+			cfg:     MQTTSettings{Broker: "localhost", Port: 1883},
+			brokers: []string{"tcp://localhost:1883"},
+		},
+		{
+			name:    "all schemes",
+			cfg:     MQTTSettings{Brokers: []string{"tcp://a:1883", "ws://b:80/mqtt", "ssl://c:8883", "wss://d:443/mqtt"}},
+			brokers: []string{"tcp://a:1883", "ws://b:80/mqtt", "ssl://c:8883", "wss://d:443/mqtt"},
+			tls:     true,
+		},
+		{
+			name: "unsupported scheme",
+			cfg:  MQTTSettings{Brokers: []string{"tcp://a:1883", "mqtt://b:1883"}},
+			err:  "unsupported scheme 'mqtt'",
+		},
+		{
+			name: "bad url",
+			cfg:  MQTTSettings{Brokers: []string{"tcp://a:port"}},
+			err:  "broker 'tcp://a:port'",
+		},
+		{
+			name: "tls settings on tcp",
+			cfg:  MQTTSettings{Brokers: []string{"tcp://a:1883"}, TLS: MQTTTLSSettings{CA: cert}},
+			err:  "need an ssl:// or wss:// broker",
+		},
+		{
+			name: "tls settings on ws",
+			cfg:  MQTTSettings{Brokers: []string{"ws://a:80"}, TLS: MQTTTLSSettings{InsecureSkipVerify: true}},
+			err:  "need an ssl:// or wss:// broker",
+		},
+		{
+			name:    "ca",
+			cfg:     MQTTSettings{Brokers: []string{"ssl://a:8883"}, TLS: MQTTTLSSettings{CA: cert}},
+			brokers: []string{"ssl://a:8883"},
+			tls:     true,
+		},
+		{
+			name: "missing ca",
+			cfg:  MQTTSettings{Brokers: []string{"ssl://a:8883"}, TLS: MQTTTLSSettings{CA: filepath.Join(dir, "missing.pem")}},
+			err:  "tls ca:",
+		},
+		{
+			name: "ca without certificates",
+			cfg:  MQTTSettings{Brokers: []string{"ssl://a:8883"}, TLS: MQTTTLSSettings{CA: notPEM}},
+			err:  "no certificates",
+		},
+		{
+			name:    "client certificate",
+			cfg:     MQTTSettings{Brokers: []string{"wss://a:443"}, TLS: MQTTTLSSettings{Cert: cert, Key: key}},
+			brokers: []string{"wss://a:443"},
+			tls:     true,
+			certs:   1,
+		},
+		{
+			name: "cert without key",
+			cfg:  MQTTSettings{Brokers: []string{"ssl://a:8883"}, TLS: MQTTTLSSettings{Cert: cert}},
+			err:  "cert and key must be set together",
+		},
+		{
+			name: "key without cert",
+			cfg:  MQTTSettings{Brokers: []string{"ssl://a:8883"}, TLS: MQTTTLSSettings{Key: key}},
+			err:  "cert and key must be set together",
+		},
+		{
+			name: "mismatched cert and key",
+			cfg:  MQTTSettings{Brokers: []string{"ssl://a:8883"}, TLS: MQTTTLSSettings{Cert: key, Key: cert}},
+			err:  "tls client certificate",
+		},
+		{
+			name: "shared group needs version 5",
+			cfg:  MQTTSettings{Brokers: []string{"tcp://a:1883"}, SharedGroup: "zappy"},
+			err:  "need MQTT version 5",
+		},
+		{
+			name:    "version 5",
+			cfg:     MQTTSettings{Brokers: []string{"tcp://a:1883"}, Version: 5, SharedGroup: "zappy"},
+			brokers: []string{"tcp://a:1883"},
+		},
+		{
+			name: "unsupported version",
+			cfg:  MQTTSettings{Brokers: []string{"tcp://a:1883"}, Version: 4},
+			err:  "unsupported MQTT version 4",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			options, err := mqttClientOptions(&tt.cfg)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got error %v, want %q", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if strings.Join(options.Brokers, " ") != strings.Join(tt.brokers, " ") {
+				t.Errorf("brokers %v, want %v", options.Brokers, tt.brokers)
+			}
+
+			if (options.TLS != nil) != tt.tls {
+				t.Fatalf("tls config %v, want %v", options.TLS != nil, tt.tls)
+			}
+			if options.TLS == nil {
+				return
+			}
+
+			if len(options.TLS.Certificates) != tt.certs {
+				t.Errorf("%d client certificates, want %d", len(options.TLS.Certificates), tt.certs)
+			}
+			if (options.TLS.RootCAs != nil) != (tt.cfg.TLS.CA != "") {
+				t.Errorf("root CAs %v, want CA %q", options.TLS.RootCAs, tt.cfg.TLS.CA)
+			}
+		})
+	}
+}
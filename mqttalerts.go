@@ -0,0 +1,138 @@
+package main
+
+import (
+	"fmt"
+	"log"
+
+	hassiomqtt "github.com/netleapio/zappy-controller/hassio-mqtt"
+	"github.com/netleapio/zappy-framework/protocol"
+)
+
+// hassAlerts describes how each alert bit appears in Home Assistant
+var hassAlerts = []struct {
+	alert       protocol.Alerts
+	name        string
+	deviceClass string
+}{
+	{protocol.AlertBattLow, "battery_low", "battery"},
+	{protocol.AlertBattCritical, "battery_critical", "battery"},
+	{protocol.AlertRTCFailure, "rtc_failure", "problem"},
+}
+
+// Device trigger types of alerts, the subtype being the alert name
+const (
+	triggerAlertRaised  = "alert_raised"
+	triggerAlertCleared = "alert_cleared"
+)
+
+// addAlertEntities creates the binary sensor and raised/cleared triggers
+// of each alert of a device that are not already created, so any that
+// failed are retried on the next update
+func (l *MQTTListener) addAlertEntities(dev *mqttDevice, id uint16) {
+	deviceId := l.deviceId(id)
+	for _, a := range hassAlerts {
+		if _, ok := dev.alertSensors[a.alert]; !ok {
+			sensorId := fmt.Sprintf("%s_alert_%s", deviceId, a.name)
+
+			s, err := hassiomqtt.NewBinarySensor(dev.hassDevice, sensorId, &hassiomqtt.BinarySensorModel{
+				EntityModel: hassiomqtt.EntityModel{
+					Availability:     dev.hassDevice.DeviceAvailability(),
+					AvailabilityMode: "all",
+					DeviceClass:      a.deviceClass,
+					EntityCategory:   "diagnostic",
+					Name:             a.name,
+					ObjectID:         sensorId,
+					ValueTemplate:    fmt.Sprintf("{{value_json.alert_%s}}", a.name),
+				},
+			})
+			if err != nil {
+				log.Printf("Device #%04x: failed to add %s alert: %v", id, a.name, err)
+			} else {
+				dev.alertSensors[a.alert] = s
+			}
+		}
+
+		for _, triggerType := range []string{triggerAlertRaised, triggerAlertCleared} {
+			triggerId := fmt.Sprintf("%s_%s_%s", deviceId, triggerType, a.name)
+			if _, ok := dev.alertTriggers[triggerId]; ok {
+				continue
+			}
+
+			t, err := hassiomqtt.NewDeviceTrigger(dev.hassDevice, triggerId, &hassiomqtt.DeviceTriggerModel{
+				Type:    triggerType,
+				Subtype: a.name,
+			})
+			if err != nil {
+				log.Printf("Device #%04x: failed to add %s trigger: %v", id, triggerId, err)
+				continue
+			}
+			dev.alertTriggers[triggerId] = t
+		}
+	}
+}
+
+// alertStatus adds the state of each alert to a device's status
+func alertStatus(status map[string]interface{}, alerts protocol.Alerts) {
+	for _, a := range hassAlerts {
+		state := "OFF"
+		if alerts&a.alert != 0 {
+			state = "ON"
+		}
+		status["alert_"+a.name] = state
+	}
+}
+
+// fireAlertTriggers fires the triggers of alerts raised or cleared since
+// last published.  Alerts already raised when the device is first seen
+// do not fire.
+func (l *MQTTListener) fireAlertTriggers(dev *mqttDevice, d *DeviceState) {
+	prev := dev.alerts
+	alerts := d.alerts
+	dev.alerts = &alerts
+	if prev == nil {
+		return
+	}
+
+	deviceId := l.deviceId(d.id)
+	for _, a := range hassAlerts {
+		triggerType := ""
+		switch {
+		case d.alerts&a.alert != 0 && *prev&a.alert == 0:
+			triggerType = triggerAlertRaised
+		case d.alerts&a.alert == 0 && *prev&a.alert != 0:
+			triggerType = triggerAlertCleared
+		default:
+			continue
+		}
+
+		t, ok := dev.alertTriggers[fmt.Sprintf("%s_%s_%s", deviceId, triggerType, a.name)]
+		if !ok {
+			continue
+		}
+
+		err := t.Fire(triggerType)
+		if err != nil {
+			log.Printf("Device #%04x: failed to fire %s trigger: %v", d.id, triggerType, err)
+		}
+	}
+}
+
+// removeAlertEntities deletes a device's alert entities from Home
+// Assistant
+func (l *MQTTListener) removeAlertEntities(dev *mqttDevice) {
+	for alert, s := range dev.alertSensors {
+		err := s.Remove()
+		if err != nil {
+			log.Printf("failed to remove entity %s: %v", s.ID(), err)
+		}
+		delete(dev.alertSensors, alert)
+	}
+
+	for id, t := range dev.alertTriggers {
+		err := t.Remove()
+		if err != nil {
+			log.Printf("failed to remove trigger %s: %v", id, err)
+		}
+		delete(dev.alertTriggers, id)
+	}
+}
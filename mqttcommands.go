@@ -0,0 +1,369 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"strconv"
+	"strings"
+
+	hassiomqtt "github.com/netleapio/zappy-controller/hassio-mqtt"
+	"github.com/netleapio/zappy-framework/protocol"
+)
+
+// Commands accepted over MQTT
+const (
+	CommandCoils          = "coils"
+	CommandReportInterval = "report_interval"
+	CommandIdentify       = "identify"
+	CommandRename         = "rename"
+	CommandForget         = "forget"
+)
+
+var mqttCommands = []string{CommandCoils, CommandReportInterval, CommandIdentify, CommandRename, CommandForget}
+
+// downlinkCommands are sent to the device, so are only offered when the
+// downlink is enabled
+var downlinkCommands = map[string]bool{CommandCoils: true, CommandReportInterval: true, CommandIdentify: true}
+
+// Command outcomes published as acknowledgements
+const (
+	CommandAccepted = "accepted"
+	CommandDenied   = "denied"
+	CommandFailed   = "failed"
+)
+
+var errDeviceNotTracked = errors.New("device is not being tracked")
+
+// mqttCommand is a command received on the controller command topic
+type mqttCommand struct {
+	Device  uint16 `json:"device"`
+	Command string `json:"command"`
+	Value   any    `json:"value"`
+}
+
+// mqttCommandAck is published once a command has been handled
+type mqttCommandAck struct {
+	Device  uint16 `json:"device"`
+	Command string `json:"command"`
+	Value   string `json:"value,omitempty"`
+	Topic   string `json:"topic"`
+	Status  string `json:"status"`
+	Error   string `json:"error,omitempty"`
+}
+
+// stateEntity is an entity that publishes its own state
+type stateEntity interface {
+	hassiomqtt.Entity
+	SendState(state interface{}) error
+}
+
+// commandAuth holds the commands allowed on each kind of topic
+type commandAuth struct {
+	entities   map[string]bool
+	controller map[string]bool
+	devices    map[uint16]bool
+}
+
+func newCommandAuth(cfg *MQTTCommandSettings) (*commandAuth, error) {
+	a := &commandAuth{
+		entities:   map[string]bool{},
+		controller: map[string]bool{},
+		devices:    map[uint16]bool{},
+	}
+
+	for _, list := range []struct {
+		names   []string
+		allowed map[string]bool
+	}{{cfg.Entities, a.entities}, {cfg.Controller, a.controller}} {
+		for _, name := range list.names {
+			if !isMQTTCommand(name) {
+				return nil, fmt.Errorf("unknown command '%s'", name)
+			}
+			list.allowed[name] = true
+		}
+	}
+
+	for _, id := range cfg.Devices {
+		a.devices[id] = true
+	}
+
+	return a, nil
+}
+
+func isMQTTCommand(name string) bool {
+	for _, c := range mqttCommands {
+		if c == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (a *commandAuth) allowed(allowed map[string]bool, id uint16, command string) bool {
+	return allowed[command] && (len(a.devices) == 0 || a.devices[id])
+}
+
+// addControls creates the command entities of a device not yet created.
+// Called from the listener's loop.
+func (l *MQTTListener) addControls(dev *mqttDevice, d *DeviceState) {
+	if d.zone != "" {
+		return
+	}
+
+	for _, command := range mqttCommands {
+		if _, ok := dev.controls[command]; ok || !l.auth.allowed(l.auth.entities, d.id, command) {
+			continue
+		}
+		if downlinkCommands[command] && !l.downlink.Enabled() {
+			continue
+		}
+
+		e, err := l.newControl(dev, d, command)
+		if err != nil {
+			log.Printf("Device #%04x: failed to add %s entity: %v", d.id, command, err)
+			continue
+		}
+		if e != nil {
+			dev.controls[command] = e
+		}
+	}
+
+	if e, ok := dev.controls[CommandRename].(stateEntity); ok {
+		e.SendState(l.manager.DeviceName(d.id))
+	}
+}
+
+func (l *MQTTListener) newControl(dev *mqttDevice, d *DeviceState, command string) (hassiomqtt.Entity, error) {
+	id := d.id
+	entityId := fmt.Sprintf("%s_%s", l.deviceId(id), command)
+	onCommand := func(payload string) {
+		l.runCommand(dev.hassDevice.CommandTopic(entityId), id, command, payload)
+	}
+
+	base := hassiomqtt.EntityModel{
+		Availability:     dev.hassDevice.DeviceAvailability(),
+		AvailabilityMode: "all",
+		EntityCategory:   "config",
+		Name:             strings.ReplaceAll(command, "_", " "),
+		ObjectID:         entityId,
+	}
+
+	switch command {
+	case CommandCoils:
+		if _, ok := d.sensors[protocol.SensorTypeCoils]; !ok {
+			return nil, nil
+		}
+		base.EntityCategory = ""
+		return hassiomqtt.NewSwitch(dev.hassDevice, entityId, &hassiomqtt.SwitchModel{EntityModel: base}, onCommand)
+	case CommandReportInterval:
+		min, max := 1.0, float64(^uint16(0))
+		return hassiomqtt.NewNumber(dev.hassDevice, entityId, &hassiomqtt.NumberModel{
+			EntityModel:       base,
+			Min:               &min,
+			Max:               &max,
+			Mode:              "box",
+			UnitOfMeasurement: "s",
+		}, onCommand)
+	case CommandIdentify:
+		base.DeviceClass = "identify"
+		base.EntityCategory = ""
+		return hassiomqtt.NewButton(dev.hassDevice, entityId, &hassiomqtt.ButtonModel{EntityModel: base}, onCommand)
+	case CommandRename:
+		base.Name = "name"
+		return hassiomqtt.NewText(dev.hassDevice, entityId, &hassiomqtt.TextModel{EntityModel: base}, onCommand)
+	case CommandForget:
+		return hassiomqtt.NewButton(dev.hassDevice, entityId, &hassiomqtt.ButtonModel{EntityModel: base}, onCommand)
+	}
+
+	return nil, nil
+}
+
+// handleControllerCommand handles a JSON command on the controller command
+// topic.  Runs on the MQTT client's goroutine.
+func (l *MQTTListener) handleControllerCommand(payload string) {
+	topic := l.mqtt.CommandTopic()
+
+	cmd := mqttCommand{}
+	err := json.Unmarshal([]byte(payload), &cmd)
+	if err != nil {
+		log.Printf("MQTT: bad command on %s: %v", topic, err)
+		l.ack(mqttCommandAck{Topic: topic, Status: CommandFailed, Error: err.Error()})
+		return
+	}
+
+	value := ""
+	if cmd.Value != nil {
+		value = fmt.Sprint(cmd.Value)
+	}
+
+	l.runCommand(topic, cmd.Device, cmd.Command, value)
+}
+
+// runCommand authorizes and runs a command received on a topic,
+// acknowledging the outcome.  Runs on the MQTT client's goroutine.
+func (l *MQTTListener) runCommand(topic string, id uint16, command string, value string) {
+	allowed := l.auth.entities
+	if topic == l.mqtt.CommandTopic() {
+		allowed = l.auth.controller
+	}
+
+	ack := mqttCommandAck{Device: id, Command: command, Value: value, Topic: topic, Status: CommandAccepted}
+
+	if !l.auth.allowed(allowed, id, command) {
+		log.Printf("Device #%04x: %s denied on %s", id, command, topic)
+		ack.Status = CommandDenied
+		l.ack(ack)
+		return
+	}
+
+	err := l.execute(id, command, value)
+	if err != nil {
+		log.Printf("Device #%04x: %s failed: %v", id, command, err)
+		ack.Status = CommandFailed
+		ack.Error = err.Error()
+	}
+
+	l.ack(ack)
+}
+
+func (l *MQTTListener) execute(id uint16, command string, value string) error {
+	switch command {
+	case CommandRename:
+		value = strings.TrimSpace(value)
+		if value == "" {
+			return errors.New("name is empty")
+		}
+		err := l.manager.Rename(id, value)
+		if err != nil {
+			return err
+		}
+		l.actions <- func() { l.renameDevice(id) }
+		return nil
+	case CommandForget:
+		return l.manager.Forget(id)
+	}
+
+	if d := l.manager.Snapshot(id); d == nil || d.zone != "" {
+		return errDeviceNotTracked
+	}
+
+	switch command {
+	case CommandCoils:
+		coils, err := parseCoils(value)
+		if err != nil {
+			return err
+		}
+		return l.downlink.Queue(id, ConfigCoils, coils)
+	case CommandReportInterval:
+		// Numbers from Home Assistant may have a decimal point
+		seconds, err := strconv.ParseFloat(value, 64)
+		if err != nil || seconds < 1 || seconds > float64(^uint16(0)) || seconds != math.Trunc(seconds) {
+			return fmt.Errorf("bad report interval '%s'", value)
+		}
+		err = l.downlink.Queue(id, ConfigReportInterval, uint16(seconds))
+		if err != nil {
+			return err
+		}
+		l.actions <- func() { l.sendControlState(id, command, value) }
+	case CommandIdentify:
+		return l.downlink.Queue(id, ConfigIdentify, 1)
+	default:
+		return fmt.Errorf("unknown command '%s'", command)
+	}
+
+	return nil
+}
+
+// parseCoils accepts a switch payload or a coil bitmask
+func parseCoils(value string) (uint16, error) {
+	switch value {
+	case "ON":
+		return 1, nil
+	case "OFF":
+		return 0, nil
+	}
+
+	coils, err := strconv.ParseUint(value, 0, 16)
+	if err != nil {
+		return 0, fmt.Errorf("bad coils '%s'", value)
+	}
+
+	return uint16(coils), nil
+}
+
+// sendControlState publishes the state of a device's command entity.
+// Called from the listener's loop.
+func (l *MQTTListener) sendControlState(id uint16, command string, state string) {
+	dev, ok := l.devices[id]
+	if !ok {
+		return
+	}
+
+	if e, ok := dev.controls[command].(stateEntity); ok {
+		e.SendState(state)
+	}
+}
+
+func (l *MQTTListener) ack(ack mqttCommandAck) {
+	data, err := json.Marshal(&ack)
+	if err != nil {
+		return
+	}
+
+	err = l.Publish(l.mqtt.AckTopic(), string(data))
+	if err != nil {
+		log.Printf("MQTT: failed to acknowledge command: %v", err)
+	}
+}
+
+// renameDevice publishes a device's new name.  Called from the listener's
+// loop.
+func (l *MQTTListener) renameDevice(id uint16) {
+	dev, ok := l.devices[id]
+	if !ok {
+		return
+	}
+
+	name := l.manager.DeviceName(id)
+	err := dev.hassDevice.Rename(name)
+	if err != nil {
+		log.Printf("Device #%04x: failed to rename entities: %v", id, err)
+	}
+
+	l.sendControlState(id, CommandRename, name)
+}
+
+// updateControls publishes the state of command entities that follow the
+// device's readings
+func (l *MQTTListener) updateControls(dev *mqttDevice, d *DeviceState) {
+	e, ok := dev.controls[CommandCoils].(stateEntity)
+	if !ok {
+		return
+	}
+
+	r, ok := d.sensors[protocol.SensorTypeCoils]
+	if !ok || r.Stale {
+		return
+	}
+
+	state := "OFF"
+	if r.Value != 0 {
+		state = "ON"
+	}
+	e.SendState(state)
+}
+
+// removeControls deletes a device's command entities from Home Assistant
+func (l *MQTTListener) removeControls(dev *mqttDevice) {
+	for command, e := range dev.controls {
+		err := e.Remove()
+		if err != nil {
+			log.Printf("failed to remove entity %s: %v", e.ID(), err)
+		}
+		delete(dev.controls, command)
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"time"
+
+	hassiomqtt "github.com/netleapio/zappy-controller/hassio-mqtt"
+)
+
+// hassDiagnostics are the entities published about each device's link,
+// alongside the packet loss and report interval readings.  The radio does
+// not report RSSI or SNR, so there are no signal entities.
+var hassDiagnostics = []struct {
+	name        string
+	deviceClass string
+	stateClass  string
+	icon        string
+
+	// noisy entities are disabled until enabled in Home Assistant
+	noisy bool
+}{
+	{"last_seen", "timestamp", "", "mdi:clock-check-outline", false},
+	{"firmware", "", "", "mdi:chip", false},
+	{"packets", "", "total_increasing", "mdi:counter", true},
+	{"duplicates", "", "total_increasing", "mdi:content-duplicate", true},
+	{"decode_failures", "", "total_increasing", "mdi:alert-circle-outline", true},
+}
+
+// addDiagnostics creates the diagnostic entities of a device not yet
+// created
+func (l *MQTTListener) addDiagnostics(dev *mqttDevice, d *DeviceState) {
+	if d.zone != "" {
+		return
+	}
+
+	for _, diag := range hassDiagnostics {
+		if _, ok := dev.diagnostics[diag.name]; ok {
+			continue
+		}
+
+		var enabled *bool
+		if diag.noisy {
+			enabled = new(bool)
+		}
+
+		entityId := fmt.Sprintf("%s_%s", l.deviceId(d.id), diag.name)
+		e, err := hassiomqtt.NewSensor(dev.hassDevice, entityId, &hassiomqtt.SensorModel{
+			EntityModel: hassiomqtt.EntityModel{
+				Availability:     dev.hassDevice.DeviceAvailability(),
+				AvailabilityMode: "all",
+				DeviceClass:      diag.deviceClass,
+				EnabledByDefault: enabled,
+				EntityCategory:   "diagnostic",
+				Icon:             diag.icon,
+				Name:             diag.name,
+				ObjectID:         entityId,
+				ValueTemplate:    fmt.Sprintf("{{value_json.%s}}", diag.name),
+			},
+			StateClass: diag.stateClass,
+		})
+		if err != nil {
+			log.Printf("Device #%04x: failed to add %s entity: %v", d.id, diag.name, err)
+			continue
+		}
+		dev.diagnostics[diag.name] = e
+	}
+}
+
+// diagnosticStatus adds the diagnostics of a device to its status
+func (l *MQTTListener) diagnosticStatus(status map[string]interface{}, d *DeviceState) {
+	if d.zone != "" {
+		return
+	}
+
+	status["last_seen"] = d.lastSeen.Format(time.RFC3339)
+
+	t, ok := l.manager.TrafficStats(d.id)
+	if !ok {
+		return
+	}
+
+	status["packets"] = t.Packets
+	status["duplicates"] = t.Duplicates
+	status["decode_failures"] = t.DecodeFailures
+	if n := len(t.Versions); n > 0 {
+		status["firmware"] = t.Versions[n-1].Version
+	}
+}
+
+// removeDiagnostics deletes a device's diagnostic entities from Home
+// Assistant
+func (l *MQTTListener) removeDiagnostics(dev *mqttDevice) {
+	for name, e := range dev.diagnostics {
+		err := e.Remove()
+		if err != nil {
+			log.Printf("failed to remove entity %s: %v", e.ID(), err)
+		}
+		delete(dev.diagnostics, name)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+
+	hassiomqtt "github.com/netleapio/zappy-controller/hassio-mqtt"
+)
+
+// hubUpdatePeriod is how often the controller's own status is published
+const hubUpdatePeriod = time.Minute
+
+// hubSensors are the diagnostics of the controller published to Home
+// Assistant
+var hubSensors = []struct {
+	name        string
+	deviceClass string
+	stateClass  string
+	unit        string
+	icon        string
+}{
+	{"uptime", "duration", "", "s", ""},
+	{"packets_per_minute", "", "measurement", "packets/min", "mdi:radio-tower"},
+	{"decode_errors", "", "total_increasing", "", "mdi:alert-circle-outline"},
+	{"devices_online", "", "measurement", "", "mdi:access-point-network"},
+}
+
+const hubRadioConnected = "radio_connected"
+
+// hubId identifies the controller in Home Assistant, which other devices
+// are linked to with via_device
+func (l *MQTTListener) hubId() string {
+	return fmt.Sprintf("zappy_%d_controller", l.network)
+}
+
+// addHub publishes the controller as a device, creating any of its
+// entities not yet created.  Called from the listener's loop.
+func (l *MQTTListener) addHub() {
+	if l.hub == nil {
+		l.hub = hassiomqtt.NewDevice(l.mqtt, "controller", &hassiomqtt.DeviceModel{
+			Identifiers:     []string{l.hubId()},
+			Manufacturer:    fallbackProfile.Manufacturer,
+			Model:           "Zappy Controller",
+			Name:            "Zappy Controller",
+			SoftwareVersion: controllerVersion(),
+		})
+	}
+
+	availability := []hassiomqtt.AvailabilityModel{{Topic: l.mqtt.BridgeAvailabilityTopic()}}
+
+	for _, s := range hubSensors {
+		if _, ok := l.hubEntities[s.name]; ok {
+			continue
+		}
+
+		entityId := fmt.Sprintf("%s_%s", l.hubId(), s.name)
+		e, err := hassiomqtt.NewSensor(l.hub, entityId, &hassiomqtt.SensorModel{
+			EntityModel: hassiomqtt.EntityModel{
+				Availability:   availability,
+				DeviceClass:    s.deviceClass,
+				EntityCategory: "diagnostic",
+				Icon:           s.icon,
+				Name:           s.name,
+				ObjectID:       entityId,
+				ValueTemplate:  fmt.Sprintf("{{value_json.%s}}", s.name),
+			},
+			StateClass:        s.stateClass,
+			UnitOfMeasurement: s.unit,
+		})
+		if err != nil {
+			log.Printf("MQTT: failed to add controller %s: %v", s.name, err)
+			continue
+		}
+		l.hubEntities[s.name] = e
+	}
+
+	if _, ok := l.hubEntities[hubRadioConnected]; !ok {
+		entityId := fmt.Sprintf("%s_%s", l.hubId(), hubRadioConnected)
+		e, err := hassiomqtt.NewBinarySensor(l.hub, entityId, &hassiomqtt.BinarySensorModel{
+			EntityModel: hassiomqtt.EntityModel{
+				Availability:   availability,
+				DeviceClass:    "connectivity",
+				EntityCategory: "diagnostic",
+				Name:           hubRadioConnected,
+				ObjectID:       entityId,
+				ValueTemplate:  fmt.Sprintf("{{value_json.%s}}", hubRadioConnected),
+			},
+		})
+		if err != nil {
+			log.Printf("MQTT: failed to add controller %s: %v", hubRadioConnected, err)
+		} else {
+			l.hubEntities[hubRadioConnected] = e
+		}
+	}
+}
+
+// updateHub publishes the controller's status.  Called from the
+// listener's loop.
+func (l *MQTTListener) updateHub(now time.Time) {
+	if l.hub == nil || !l.mqtt.IsConnected() {
+		return
+	}
+
+	status := l.manager.Controller()
+
+	radio := "OFF"
+	if status.RadioConnected() {
+		radio = "ON"
+	}
+
+	traffic, decodeErrors := l.manager.AllTrafficStats()
+	for _, t := range traffic {
+		decodeErrors += t.DecodeFailures
+	}
+
+	online := 0
+	l.manager.VisitDevices(func(d *DeviceState) {
+		if d.zone == "" {
+			online++
+		}
+	})
+
+	data, err := json.Marshal(map[string]interface{}{
+		"uptime":             int64(status.Uptime(now).Seconds()),
+		"packets_per_minute": status.PacketsPerMinute(now),
+		"decode_errors":      decodeErrors,
+		"devices_online":     online,
+		hubRadioConnected:    radio,
+	})
+	if err != nil {
+		return
+	}
+
+	err = l.hub.SendStatus(string(data))
+	if err != nil {
+		log.Printf("MQTT: failed to send controller status: %v", err)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+)
+
+// Onboarding modes
+const (
+	OnboardingOpen     = "open"
+	OnboardingApproval = "approval"
+)
+
+// PendingDevice is an unknown device waiting for approval
+type PendingDevice struct {
+	ID        uint16
+	FirstSeen time.Time
+	LastSeen  time.Time
+	Packets   uint64
+}
+
+// OnboardingStatus summarises onboarding state
+type OnboardingStatus struct {
+	Mode         string
+	PairingUntil time.Time `json:",omitempty"`
+	Pending      []PendingDevice
+	Rejected     map[uint16]uint64
+}
+
+// onboarding decides which devices the manager tracks.
+//
+// In approval mode, unknown devices are held as pending until approved,
+// unless a pairing window is open in which case they are approved
+// automatically.  Packets from rejected devices are ignored and counted.
+type onboarding struct {
+	mode         string
+	allow        map[uint16]bool
+	pending      map[uint16]*PendingDevice
+	rejected     map[uint16]uint64
+	pairingUntil time.Time
+}
+
+func newOnboarding(cfg *OnboardingSettings) (*onboarding, error) {
+	o := &onboarding{
+		mode:     cfg.Mode,
+		allow:    map[uint16]bool{},
+		pending:  map[uint16]*PendingDevice{},
+		rejected: map[uint16]uint64{},
+	}
+
+	switch o.mode {
+	case "":
+		o.mode = OnboardingOpen
+	case OnboardingOpen, OnboardingApproval:
+	default:
+		return nil, fmt.Errorf("unknown onboarding mode '%s'", cfg.Mode)
+	}
+
+	for _, id := range cfg.Allow {
+		o.allow[id] = true
+	}
+
+	return o, nil
+}
+
+// admit decides whether to track a device that has sent a packet, noting
+// it as pending or rejected if not.  Must be called with the lock held.
+func (m *DeviceManager) admit(id uint16, now time.Time) bool {
+	o := m.onboarding
+
+	if _, ok := m.devices[id]; ok {
+		return true
+	}
+
+	entry, known := m.registry.Get(id)
+	switch {
+	case known && entry.Status == RegistryRejected:
+		o.rejected[id]++
+		return false
+	case known && entry.Status == RegistryApproved:
+		return true
+	case o.mode == OnboardingOpen || o.allow[id]:
+		return true
+	case now.Before(o.pairingUntil):
+		log.Printf("Device #%04x: approved during pairing window", id)
+		delete(o.pending, id)
+		m.setRegistryStatus(id, RegistryApproved)
+		return true
+	}
+
+	p, ok := o.pending[id]
+	if !ok {
+		log.Printf("Device #%04x: pending approval", id)
+		m.events.Record(deviceEvent(id, EventDevicePending, "", nil))
+		p = &PendingDevice{ID: id, FirstSeen: now}
+		o.pending[id] = p
+		m.notifyListeners(id, ChangeDevicePending)
+	}
+	p.LastSeen = now
+	p.Packets++
+
+	return false
+}
+
+// setRegistryStatus records the status of a device, keeping other details
+func (m *DeviceManager) setRegistryStatus(id uint16, status string) error {
+	entry, _ := m.registry.Get(id)
+	entry.ID = id
+	entry.Status = status
+
+	err := m.registry.Set(entry)
+	if err != nil {
+		log.Printf("Device #%04x: failed to save registry: %v", id, err)
+	}
+
+	return err
+}
+
+// Approve accepts a device, which is tracked from its next report
+func (m *DeviceManager) Approve(id uint16) error {
+	return m.doLocked(func() error {
+		delete(m.onboarding.pending, id)
+		delete(m.onboarding.rejected, id)
+		return m.setRegistryStatus(id, RegistryApproved)
+	})
+}
+
+// Reject ignores a device from now on, forgetting it if already tracked
+func (m *DeviceManager) Reject(id uint16) error {
+	return m.doLocked(func() error {
+		delete(m.onboarding.pending, id)
+
+		if _, ok := m.devices[id]; ok {
+			delete(m.devices, id)
+			m.alerts.Clear(collisionAlertName(id))
+			m.notifyListeners(id, DeviceChangeTypes(ChangeDeviceGone|ChangeDeviceRemoved))
+			m.updateZonesFor(id, time.Now())
+		}
+
+		return m.setRegistryStatus(id, RegistryRejected)
+	})
+}
+
+// OpenPairing approves all new devices for a period, zero closes pairing
+func (m *DeviceManager) OpenPairing(d time.Duration) {
+	m.doLocked(func() error {
+		m.onboarding.pairingUntil = time.Now().Add(d)
+
+		// Pending devices were waiting for exactly this
+		if d > 0 {
+			for id := range m.onboarding.pending {
+				log.Printf("Device #%04x: approved during pairing window", id)
+				m.setRegistryStatus(id, RegistryApproved)
+			}
+			m.onboarding.pending = map[uint16]*PendingDevice{}
+		}
+		return nil
+	})
+}
+
+// Onboarding gets the current onboarding state
+func (m *DeviceManager) Onboarding() OnboardingStatus {
+	result := OnboardingStatus{}
+
+	m.doLocked(func() error {
+		o := m.onboarding
+
+		result.Mode = o.mode
+		result.Pending = []PendingDevice{}
+		result.Rejected = map[uint16]uint64{}
+
+		if time.Now().Before(o.pairingUntil) {
+			result.PairingUntil = o.pairingUntil
+		}
+
+		for _, p := range o.pending {
+			result.Pending = append(result.Pending, *p)
+		}
+		sort.Slice(result.Pending, func(i, j int) bool { return result.Pending[i].ID < result.Pending[j].ID })
+
+		for id, n := range o.rejected {
+			result.Rejected[id] = n
+		}
+		return nil
+	})
+
+	return result
+}
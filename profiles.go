@@ -0,0 +1,209 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/netleapio/zappy-framework/protocol"
+)
+
+// builtinProfiles holds the default sensor presentation and the profiles
+// of known models, the last of which matches any device
+//
+//go:embed profiles.json
+var builtinProfiles []byte
+
+// SensorProfile describes how outputs present one sensor
+type SensorProfile struct {
+	Icon       string
+	Diagnostic bool
+	Disabled   bool
+
+	// Precision overrides that of the output unit if set
+	Precision *int
+}
+
+// DeviceProfile describes a model of device
+type DeviceProfile struct {
+	Name             string
+	Manufacturer     string
+	Model            string
+	ExpectedInterval time.Duration
+
+	match   ProfileMatchSettings
+	sensors map[protocol.SensorType]SensorProfile
+}
+
+// Sensor gets the presentation of a sensor type on this model
+func (p *DeviceProfile) Sensor(t protocol.SensorType) SensorProfile {
+	return p.sensors[t]
+}
+
+// Precision gets the number of decimal places to display a reading with
+func (p *DeviceProfile) Precision(t protocol.SensorType, unit Unit) int {
+	if sp := p.sensors[t]; sp.Precision != nil {
+		return *sp.Precision
+	}
+
+	return unitInfo[unit].precision
+}
+
+// DisplayName gets the name to show for a device or zone of this model
+func (p *DeviceProfile) DisplayName(d *DeviceState) string {
+	if d.zone != "" {
+		return fmt.Sprintf("%s %s", p.Model, d.zone)
+	}
+
+	return fmt.Sprintf("%s #%d", p.Model, d.id)
+}
+
+func (p *DeviceProfile) matches(d *DeviceState, version uint16, hasVersion bool) bool {
+	if p.match.Zone != (d.zone != "") {
+		return false
+	}
+
+	for _, name := range p.match.Sensors {
+		t, _ := sensorTypeByName(name)
+		if _, ok := d.sensors[t]; !ok {
+			return false
+		}
+	}
+
+	if len(p.match.Versions) == 0 {
+		return true
+	}
+
+	for _, v := range p.match.Versions {
+		if hasVersion && v == version {
+			return true
+		}
+	}
+
+	return false
+}
+
+// fallbackProfile is used should no profile match
+var fallbackProfile = &DeviceProfile{
+	Name:             "fallback",
+	Manufacturer:     "Zappy",
+	Model:            "Zappy Device",
+	ExpectedInterval: DeviceUpdatePeriod,
+	sensors:          map[protocol.SensorType]SensorProfile{},
+}
+
+// loadProfiles combines the configured profiles with the built-in ones,
+// configured profiles taking priority
+func loadProfiles(cfg []ProfileSettings) ([]*DeviceProfile, error) {
+	builtin := struct {
+		Sensors  map[string]SensorProfileSettings `json:"sensors"`
+		Profiles []ProfileSettings                `json:"profiles"`
+	}{}
+
+	err := json.Unmarshal(builtinProfiles, &builtin)
+	if err != nil {
+		return nil, fmt.Errorf("built-in profiles: %w", err)
+	}
+
+	defaults := map[protocol.SensorType]SensorProfile{}
+	err = applySensorProfiles(defaults, builtin.Sensors)
+	if err != nil {
+		return nil, fmt.Errorf("built-in profiles: %w", err)
+	}
+
+	result := []*DeviceProfile{}
+	for _, ps := range append(append([]ProfileSettings(nil), cfg...), builtin.Profiles...) {
+		p := &DeviceProfile{
+			Name:             ps.Name,
+			Manufacturer:     ps.Manufacturer,
+			Model:            ps.Model,
+			ExpectedInterval: time.Duration(ps.ExpectedInterval),
+			match:            ps.Match,
+			sensors:          map[protocol.SensorType]SensorProfile{},
+		}
+
+		if p.ExpectedInterval == 0 {
+			p.ExpectedInterval = DeviceUpdatePeriod
+		}
+
+		for _, name := range ps.Match.Sensors {
+			if _, ok := sensorTypeByName(name); !ok {
+				return nil, fmt.Errorf("profile '%s': unknown sensor type '%s'", ps.Name, name)
+			}
+		}
+
+		for t, sp := range defaults {
+			p.sensors[t] = sp
+		}
+
+		err = applySensorProfiles(p.sensors, ps.Sensors)
+		if err != nil {
+			return nil, fmt.Errorf("profile '%s': %w", ps.Name, err)
+		}
+
+		result = append(result, p)
+	}
+
+	return result, nil
+}
+
+// applySensorProfiles overrides sensor presentation with settings keyed by
+// sensor name
+func applySensorProfiles(sensors map[protocol.SensorType]SensorProfile, cfg map[string]SensorProfileSettings) error {
+	for name, s := range cfg {
+		t, ok := sensorTypeByName(name)
+		if !ok {
+			return fmt.Errorf("unknown sensor type '%s'", name)
+		}
+
+		sp := sensors[t]
+		if s.Icon != "" {
+			sp.Icon = s.Icon
+		}
+		if s.Diagnostic != nil {
+			sp.Diagnostic = *s.Diagnostic
+		}
+		if s.Precision != nil {
+			sp.Precision = s.Precision
+		}
+		if s.Disabled != nil {
+			sp.Disabled = *s.Disabled
+		}
+		sensors[t] = sp
+	}
+
+	return nil
+}
+
+// profileFor finds the profile of a device by what it reports.  Must be
+// called with the lock held.
+func (m *DeviceManager) profileFor(d *DeviceState) *DeviceProfile {
+	version, hasVersion := uint16(0), false
+	if t, ok := m.traffic[d.id]; ok && len(t.stats.Versions) > 0 {
+		version = t.stats.Versions[len(t.stats.Versions)-1].Version
+		hasVersion = true
+	}
+
+	for _, p := range m.profiles {
+		if p.matches(d, version, hasVersion) {
+			return p
+		}
+	}
+
+	return fallbackProfile
+}
+
+// Profile gets the profile of a device, nil if the device is unknown
+func (m *DeviceManager) Profile(id uint16) *DeviceProfile {
+	var result *DeviceProfile
+
+	m.doLocked(func() error {
+		if d, ok := m.devices[id]; ok {
+			result = m.profileFor(d)
+		}
+		return nil
+	})
+
+	return result
+}
@@ -12,7 +12,43 @@ import (
 
 var (
 	gaugeLabels = []string{"device_id", "network"}
-	gauges      = initGauges()
+
+	onboardingPendingDesc = prometheus.NewDesc(
+		"zappy_onboarding_pending_devices",
+		"Number of unknown devices waiting for approval",
+		[]string{"network"}, nil)
+	onboardingRejectedDesc = prometheus.NewDesc(
+		"zappy_onboarding_rejected_packets_total",
+		"Packets ignored from rejected devices",
+		gaugeLabels, nil)
+	filterRejectedDesc = prometheus.NewDesc(
+		"zappy_sensors_rejected_samples_total",
+		"Sensor samples rejected by filters",
+		append([]string{"sensor"}, gaugeLabels...), nil)
+	packetsDesc = prometheus.NewDesc(
+		"zappy_device_packets_total",
+		"Packets received from a device",
+		gaugeLabels, nil)
+	duplicatesDesc = prometheus.NewDesc(
+		"zappy_device_duplicate_packets_total",
+		"Duplicate packets received from a device",
+		gaugeLabels, nil)
+	decodeFailuresDesc = prometheus.NewDesc(
+		"zappy_device_decode_failures_total",
+		"Packets from a device that failed their CRC check",
+		gaugeLabels, nil)
+	unattributedDecodeFailuresDesc = prometheus.NewDesc(
+		"zappy_unattributed_decode_failures_total",
+		"Packets from unknown devices that failed their CRC check",
+		[]string{"network"}, nil)
+	deviceInfoDesc = prometheus.NewDesc(
+		"zappy_device_info",
+		"Profile of a device, always 1",
+		append([]string{"profile", "manufacturer", "model"}, gaugeLabels...), nil)
+	firmwareVersionDesc = prometheus.NewDesc(
+		"zappy_device_firmware_version",
+		"Firmware version last reported by a device",
+		gaugeLabels, nil)
 )
 
 type PrometheusListener struct {
@@ -20,6 +56,7 @@ type PrometheusListener struct {
 	eventChannel chan DeviceChange
 	registry     *prometheus.Registry
 	manager      *DeviceManager
+	gauges       map[protocol.SensorType]*prometheus.GaugeVec
 }
 
 func NewPrometheusListener() *PrometheusListener {
@@ -31,13 +68,22 @@ func NewPrometheusListener() *PrometheusListener {
 func (l *PrometheusListener) Init(manager *DeviceManager, network uint16) {
 	reg := prometheus.NewRegistry()
 
+	gauges := initGauges(manager.Units())
 	for _, g := range gauges {
 		reg.MustRegister(g)
 	}
 
+	reg.MustRegister(&managerCollector{listener: l})
+
 	l.network = network
 	l.registry = reg
 	l.manager = manager
+	l.gauges = gauges
+}
+
+// Register adds a collector of metrics kept elsewhere
+func (l *PrometheusListener) Register(c prometheus.Collector) {
+	l.registry.MustRegister(c)
 }
 
 func (l *PrometheusListener) Start() {
@@ -56,7 +102,11 @@ func (l *PrometheusListener) Start() {
 	go func() {
 		for {
 			change := <-l.eventChannel
-			d := l.manager.GetDevice(change.DeviceID)
+			if change.Changes&ChangeDevicePending != 0 {
+				continue
+			}
+
+			d := l.manager.Snapshot(change.DeviceID)
 			if d == nil {
 				l.removeDevice(change.DeviceID)
 			} else {
@@ -68,21 +118,37 @@ func (l *PrometheusListener) Start() {
 
 func (l *PrometheusListener) updateSensorStats(d *DeviceState) {
 	labels := l.deviceLabels(d.id)
+	units := l.manager.Units()
+
+	// Drop readings the device no longer has, such as estimates that are
+	// not currently available
+	for k, g := range l.gauges {
+		if _, ok := d.sensors[k]; !ok {
+			g.Delete(labels)
+		}
+	}
 
 	for k, v := range d.sensors {
-		md := protocol.SensorMetadata[k]
+		md := sensorMetadata[k]
 		if md == nil {
 			log.Printf("unable to update prometheus, unknown sensor: %v, %v", md, k)
 			continue
 		}
-		gauges[k].With(labels).Set(float64(v) * float64(md.Mult) / float64(md.Div))
+
+		// Drop stale readings rather than exporting an old value as current
+		if v.Stale {
+			l.gauges[k].Delete(labels)
+			continue
+		}
+
+		l.gauges[k].With(labels).Set(units.Quantity(md, v.Value).Value)
 	}
 }
 
 func (l *PrometheusListener) removeDevice(id uint16) {
 	labels := l.deviceLabels(id)
 
-	for _, v := range gauges {
+	for _, v := range l.gauges {
 		v.Delete(labels)
 	}
 }
@@ -94,16 +160,80 @@ func (l *PrometheusListener) deviceLabels(id uint16) prometheus.Labels {
 
 }
 
-func initGauges() map[protocol.SensorType]*prometheus.GaugeVec {
+func initGauges(units *Units) map[protocol.SensorType]*prometheus.GaugeVec {
 	result := map[protocol.SensorType]*prometheus.GaugeVec{}
 
-	for t, m := range protocol.SensorMetadata {
+	for t, m := range sensorMetadata {
 		result[t] = prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Namespace: "zappy",
 			Subsystem: "sensors",
-			Name:      m.Name + "_" + m.Unit,
+			Name:      units.MetricName(m),
 		}, gaugeLabels)
 	}
 
 	return result
 }
+
+// managerCollector exports statistics kept by the device manager, read
+// when scraped
+type managerCollector struct {
+	listener *PrometheusListener
+}
+
+func (c *managerCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- onboardingPendingDesc
+	ch <- onboardingRejectedDesc
+	ch <- filterRejectedDesc
+	ch <- packetsDesc
+	ch <- duplicatesDesc
+	ch <- decodeFailuresDesc
+	ch <- unattributedDecodeFailuresDesc
+	ch <- firmwareVersionDesc
+	ch <- deviceInfoDesc
+}
+
+func (c *managerCollector) Collect(ch chan<- prometheus.Metric) {
+	l := c.listener
+	networkStr := strconv.Itoa(int(l.network))
+
+	onboarding := l.manager.Onboarding()
+
+	ch <- prometheus.MustNewConstMetric(onboardingPendingDesc, prometheus.GaugeValue,
+		float64(len(onboarding.Pending)), networkStr)
+
+	for id, n := range onboarding.Rejected {
+		ch <- prometheus.MustNewConstMetric(onboardingRejectedDesc, prometheus.CounterValue,
+			float64(n), strconv.Itoa(int(id)), networkStr)
+	}
+
+	l.manager.VisitDevices(func(d *DeviceState) {
+		p := l.manager.profileFor(d)
+		ch <- prometheus.MustNewConstMetric(deviceInfoDesc, prometheus.GaugeValue,
+			1, p.Name, p.Manufacturer, p.Model, strconv.Itoa(int(d.id)), networkStr)
+
+		for t, n := range d.rejected {
+			ch <- prometheus.MustNewConstMetric(filterRejectedDesc, prometheus.CounterValue,
+				float64(n), sensorMetadata[t].Name, strconv.Itoa(int(d.id)), networkStr)
+		}
+	})
+
+	traffic, unattributed := l.manager.AllTrafficStats()
+
+	ch <- prometheus.MustNewConstMetric(unattributedDecodeFailuresDesc, prometheus.CounterValue,
+		float64(unattributed), networkStr)
+
+	for id, s := range traffic {
+		idStr := strconv.Itoa(int(id))
+		ch <- prometheus.MustNewConstMetric(packetsDesc, prometheus.CounterValue,
+			float64(s.Packets), idStr, networkStr)
+		ch <- prometheus.MustNewConstMetric(duplicatesDesc, prometheus.CounterValue,
+			float64(s.Duplicates), idStr, networkStr)
+		ch <- prometheus.MustNewConstMetric(decodeFailuresDesc, prometheus.CounterValue,
+			float64(s.DecodeFailures), idStr, networkStr)
+
+		if n := len(s.Versions); n > 0 {
+			ch <- prometheus.MustNewConstMetric(firmwareVersionDesc, prometheus.GaugeValue,
+				float64(s.Versions[n-1].Version), idStr, networkStr)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/netleapio/zappy-framework/protocol"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const publishGateCheckPeriod = time.Second
+
+var (
+	publishForwardedDesc = prometheus.NewDesc(
+		"zappy_publish_forwarded_updates_total",
+		"Device updates passed on to outputs",
+		gaugeLabels, nil)
+	publishSuppressedDesc = prometheus.NewDesc(
+		"zappy_publish_suppressed_updates_total",
+		"Device updates held back as unchanged or too frequent",
+		gaugeLabels, nil)
+)
+
+// PublishStats counts the updates of a device passed on or held back
+type PublishStats struct {
+	Forwarded  uint64
+	Suppressed uint64
+	Published  time.Time
+}
+
+type gatedDevice struct {
+	stats   PublishStats
+	values  map[protocol.SensorType]Reading
+	alerts  protocol.Alerts
+	pending bool
+}
+
+// PublishGate sits between the DeviceManager and outputs that publish
+// device state, passing on updates only when a reading has moved beyond
+// its deadband or alerts have changed, no more often than the minimum
+// interval, and at least as often as the maximum interval (a heartbeat).
+//
+// Other changes, such as new devices or stale readings, are always passed
+// on straight away.
+type PublishGate struct {
+	network      uint16
+	eventChannel chan DeviceChange
+	manager      *DeviceManager
+	listeners    []chan DeviceChange
+	minInterval  time.Duration
+	maxInterval  time.Duration
+	deadbands    map[protocol.SensorType]DeadbandSettings
+
+	lock    sync.Mutex
+	devices map[uint16]*gatedDevice
+}
+
+func NewPublishGate(cfg *PublishSettings) (*PublishGate, error) {
+	g := &PublishGate{
+		eventChannel: make(chan DeviceChange, 10),
+		listeners:    make([]chan DeviceChange, 0),
+		minInterval:  time.Duration(cfg.MinInterval),
+		maxInterval:  time.Duration(cfg.MaxInterval),
+		deadbands:    map[protocol.SensorType]DeadbandSettings{},
+		devices:      map[uint16]*gatedDevice{},
+	}
+
+	for name, db := range cfg.Deadbands {
+		t, ok := sensorTypeByName(name)
+		if !ok {
+			return nil, fmt.Errorf("unknown sensor type '%s'", name)
+		}
+		g.deadbands[t] = db
+	}
+
+	return g, nil
+}
+
+func (g *PublishGate) Init(manager *DeviceManager, network uint16) {
+	g.network = network
+	g.manager = manager
+}
+
+func (g *PublishGate) AddListener(ch chan DeviceChange) {
+	g.listeners = append(g.listeners, ch)
+}
+
+// RegisterAPI adds the gate's endpoints to the API
+func (g *PublishGate) RegisterAPI(api *API) {
+	api.HandleFunc("/api/publish", g.handleStats)
+}
+
+func (g *PublishGate) Start() {
+	go func() {
+		ticker := time.NewTicker(publishGateCheckPeriod)
+		for {
+			select {
+			case change := <-g.eventChannel:
+				g.handleChange(change, time.Now())
+			case now := <-ticker.C:
+				g.flushPending(now)
+			}
+		}
+	}()
+}
+
+func (g *PublishGate) handleChange(change DeviceChange, now time.Time) {
+	if change.Changes&^ChangeDeviceUpdate != 0 {
+		g.forward(change, now)
+		return
+	}
+
+	d := g.manager.Snapshot(change.DeviceID)
+	profile := g.manager.Profile(change.DeviceID)
+	if d == nil || profile == nil {
+		g.forward(change, now)
+		return
+	}
+
+	g.lock.Lock()
+	gd, ok := g.devices[change.DeviceID]
+	if !ok {
+		g.lock.Unlock()
+		g.forward(change, now)
+		return
+	}
+
+	due := now.Sub(gd.stats.Published)
+	publish := (g.maxInterval > 0 && due >= g.maxInterval) || d.alerts != gd.alerts || g.changed(profile, gd.values, d.sensors)
+	if publish && due < g.minInterval {
+		// Hold back until the minimum interval has passed
+		gd.pending = true
+		publish = false
+	}
+	if !publish {
+		gd.stats.Suppressed++
+	}
+	g.lock.Unlock()
+
+	if publish {
+		g.forward(change, now)
+	}
+}
+
+// changed checks whether any reading has moved beyond its deadband since
+// last published.  Diagnostic readings, such as link statistics that
+// differ on every report, only count if given a deadband; otherwise they
+// are published along with other changes and heartbeats.
+func (g *PublishGate) changed(profile *DeviceProfile, published map[protocol.SensorType]Reading, current map[protocol.SensorType]Reading) bool {
+	for t := range published {
+		if _, ok := current[t]; !ok && g.tracked(profile, t) {
+			return true
+		}
+	}
+
+	for t, r := range current {
+		if !g.tracked(profile, t) {
+			continue
+		}
+
+		prev, ok := published[t]
+		if !ok || prev.Stale != r.Stale {
+			return true
+		}
+
+		diff := math.Abs(r.Value - prev.Value)
+		db, ok := g.deadbands[t]
+		if !ok {
+			if diff != 0 {
+				return true
+			}
+			continue
+		}
+
+		if diff > db.Absolute && diff > db.Relative*math.Abs(prev.Value) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// tracked checks whether changes to a reading cause it to be published
+func (g *PublishGate) tracked(profile *DeviceProfile, t protocol.SensorType) bool {
+	if _, ok := g.deadbands[t]; ok {
+		return true
+	}
+
+	return !profile.Sensor(t).Diagnostic
+}
+
+// flushPending passes on updates that were held back by the minimum
+// interval
+func (g *PublishGate) flushPending(now time.Time) {
+	due := []uint16{}
+
+	g.lock.Lock()
+	for id, gd := range g.devices {
+		if gd.pending && now.Sub(gd.stats.Published) >= g.minInterval {
+			due = append(due, id)
+		}
+	}
+	g.lock.Unlock()
+
+	for _, id := range due {
+		g.forward(DeviceChange{DeviceID: id, Changes: ChangeDeviceUpdate}, now)
+	}
+}
+
+// forward passes a change on to the listeners, noting the readings
+// published
+func (g *PublishGate) forward(change DeviceChange, now time.Time) {
+	d := g.manager.Snapshot(change.DeviceID)
+
+	g.lock.Lock()
+	if d == nil {
+		delete(g.devices, change.DeviceID)
+	} else {
+		gd, ok := g.devices[change.DeviceID]
+		if !ok {
+			gd = &gatedDevice{}
+			g.devices[change.DeviceID] = gd
+		}
+
+		gd.values = d.sensors
+		gd.alerts = d.alerts
+		gd.pending = false
+		gd.stats.Published = now
+		gd.stats.Forwarded++
+	}
+	g.lock.Unlock()
+
+	for _, ch := range g.listeners {
+		select {
+		case ch <- change:
+		default:
+		}
+	}
+}
+
+// Stats gets the publish statistics of each device
+func (g *PublishGate) Stats() map[uint16]PublishStats {
+	g.lock.Lock()
+	defer g.lock.Unlock()
+
+	result := map[uint16]PublishStats{}
+	for id, gd := range g.devices {
+		result[id] = gd.stats
+	}
+
+	return result
+}
+
+// handleStats serves GET /api/publish, the publish statistics by device
+func (g *PublishGate) handleStats(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, g.Stats())
+}
+
+func (g *PublishGate) Describe(ch chan<- *prometheus.Desc) {
+	ch <- publishForwardedDesc
+	ch <- publishSuppressedDesc
+}
+
+func (g *PublishGate) Collect(ch chan<- prometheus.Metric) {
+	networkStr := strconv.Itoa(int(g.network))
+
+	for id, s := range g.Stats() {
+		idStr := strconv.Itoa(int(id))
+		ch <- prometheus.MustNewConstMetric(publishForwardedDesc, prometheus.CounterValue,
+			float64(s.Forwarded), idStr, networkStr)
+		ch <- prometheus.MustNewConstMetric(publishSuppressedDesc, prometheus.CounterValue,
+			float64(s.Suppressed), idStr, networkStr)
+	}
+}
@@ -52,6 +52,14 @@ func (r *radio) Rx(timeoutMs uint32, buf []byte) (int, error) {
 	return int(pktlen), nil
 }
 
+// Tx sends a packet using the same framing as received packets
+func (r *radio) Tx(buf []byte) error {
+	frame := append([]byte{'P', 'K', 'T', byte(len(buf))}, buf...)
+
+	_, err := r.port.Write(frame)
+	return err
+}
+
 func (r *radio) Close() error {
 	return r.port.Close()
 }
@@ -50,6 +50,11 @@ func (r *radio) Close() error {
 	return nil
 }
 
+func (r *radio) Tx(buf []byte) error {
+	_, err := r.bc.Write(buf)
+	return err
+}
+
 func (r *radio) Rx(timeoutMs uint32, buf []byte) (int, error) {
 	n, _, err := r.lc.ReadFromUDP(buf)
 	return n, err
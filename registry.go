@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const DefaultRegistryPath = "registry.json"
+
+// Registry statuses of a device
+const (
+	RegistryApproved = "approved"
+	RegistryRejected = "rejected"
+)
+
+// RegistryEntry records what is known about a device across restarts
+type RegistryEntry struct {
+	ID      uint16
+	Name    string `json:",omitempty"`
+	Status  string
+	Updated time.Time
+}
+
+// Registry is a persistent store of known devices, saved as JSON
+type Registry struct {
+	lock    sync.Mutex
+	path    string
+	entries map[uint16]RegistryEntry
+	events  *EventLog
+}
+
+// OpenRegistry loads the registry from a file, which need not exist yet
+func OpenRegistry(path string, events *EventLog) (*Registry, error) {
+	r := &Registry{
+		path:    path,
+		entries: map[uint16]RegistryEntry{},
+		events:  events,
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return r, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	entries := []RegistryEntry{}
+	err = json.Unmarshal(data, &entries)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range entries {
+		r.entries[e.ID] = e
+	}
+
+	return r, nil
+}
+
+func (r *Registry) Get(id uint16) (RegistryEntry, bool) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	e, ok := r.entries[id]
+	return e, ok
+}
+
+// Set adds or replaces an entry and saves the registry
+func (r *Registry) Set(e RegistryEntry) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	e.Updated = time.Now()
+	r.entries[e.ID] = e
+
+	r.events.Record(deviceEvent(e.ID, EventRegistryUpdated, e.Status, map[string]any{"name": e.Name}))
+
+	return r.save()
+}
+
+// Delete removes an entry and saves the registry
+func (r *Registry) Delete(id uint16) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	delete(r.entries, id)
+
+	r.events.Record(deviceEvent(id, EventRegistryDeleted, "", nil))
+
+	return r.save()
+}
+
+// All lists the entries in ID order
+func (r *Registry) All() []RegistryEntry {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	return r.sorted()
+}
+
+func (r *Registry) sorted() []RegistryEntry {
+	result := make([]RegistryEntry, 0, len(r.entries))
+	for _, e := range r.entries {
+		result = append(result, e)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+
+	return result
+}
+
+// save writes to a temporary file first, so a crash never leaves a
+// truncated registry
+func (r *Registry) save() error {
+	data, err := json.MarshalIndent(r.sorted(), "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmp := r.path + ".tmp"
+	err = os.WriteFile(tmp, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, r.path)
+}
@@ -0,0 +1,689 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/netleapio/zappy-framework/protocol"
+)
+
+const (
+	ruleEvaluationPeriod = 10 * time.Second
+	ruleTraceLength      = 50
+	webhookTimeout       = 10 * time.Second
+)
+
+// Rule action types
+const (
+	ActionLog     = "log"
+	ActionMQTT    = "mqtt"
+	ActionWebhook = "webhook"
+	ActionCoils   = "coils"
+	ActionAlert   = "alert"
+)
+
+var ErrUnknownRule = errors.New("unknown rule")
+
+// RuleTrace records one evaluation of a rule for a device
+type RuleTrace struct {
+	Time       time.Time
+	Rule       string
+	DeviceID   uint16
+	Result     bool
+	Active     bool
+	Transition string `json:",omitempty"`
+	Conditions []string
+	Actions    []string `json:",omitempty"`
+	DryRun     bool
+}
+
+// MQTTPublisher publishes a payload to a topic
+type MQTTPublisher func(topic string, payload string) error
+
+// condition is a compiled ConditionSettings.  Leaf conditions are one of
+// reading thresholds, alert, stale or time of day.
+type condition struct {
+	all []*condition
+	any []*condition
+	not *condition
+
+	sensor     protocol.SensorType
+	hasSensor  bool
+	above      *float64
+	below      *float64
+	hysteresis float64
+	alert      string
+	stale      bool
+	from       int
+	to         int
+	hasTime    bool
+}
+
+type rule struct {
+	name         string
+	devices      []uint16
+	when         *condition
+	holdFor      time.Duration
+	actions      []ActionSettings
+	clearActions []ActionSettings
+	dryRun       bool
+	instances    map[uint16]*ruleInstance
+	traces       []RuleTrace
+
+	// actions waiting to run for each device, only present while a worker
+	// is running them in order
+	queues map[uint16][]ruleRun
+}
+
+// ruleRun is the actions of one rule transition
+type ruleRun struct {
+	transition string
+	actions    []ActionSettings
+}
+
+// ruleInstance is the state of a rule evaluated for one device
+type ruleInstance struct {
+	active bool
+	since  time.Time
+	held   map[*condition]bool
+}
+
+// RulesEngine evaluates declarative rules whenever devices change (and
+// periodically, for time and duration based conditions), running actions
+// when a rule becomes active or inactive.
+//
+// Thresholds are in the configured output units.  Rules apply to each of
+// their devices independently, or to every device if none are listed.
+type RulesEngine struct {
+	lock         sync.Mutex
+	network      uint16
+	eventChannel chan DeviceChange
+	manager      *DeviceManager
+	downlink     *Downlink
+	publish      MQTTPublisher
+	rules        []*rule
+	httpClient   *http.Client
+}
+
+func NewRulesEngine(cfg *RulesSettings, downlink *Downlink, publish MQTTPublisher) (*RulesEngine, error) {
+	e := &RulesEngine{
+		eventChannel: make(chan DeviceChange, 10),
+		downlink:     downlink,
+		publish:      publish,
+		httpClient:   &http.Client{Timeout: webhookTimeout},
+	}
+
+	for _, rs := range cfg.Rules {
+		r, err := compileRule(&rs, cfg.DryRun)
+		if err != nil {
+			return nil, fmt.Errorf("rule '%s': %w", rs.Name, err)
+		}
+		e.rules = append(e.rules, r)
+	}
+
+	return e, nil
+}
+
+func (e *RulesEngine) Init(manager *DeviceManager, network uint16) {
+	e.network = network
+	e.manager = manager
+}
+
+// RegisterAPI adds the rules endpoints to the API
+func (e *RulesEngine) RegisterAPI(api *API) {
+	api.HandleFunc("/api/rules", e.handleRules)
+	api.HandleFunc("/api/rules/", e.handleRule)
+}
+
+func (e *RulesEngine) Start() {
+	go func() {
+		ticker := time.NewTicker(ruleEvaluationPeriod)
+		for {
+			select {
+			case change := <-e.eventChannel:
+				e.evaluateDevice(change.DeviceID, time.Now())
+				if change.Changes&ChangeDeviceRemoved != 0 {
+					e.removeDevice(change.DeviceID)
+				}
+			case now := <-ticker.C:
+				e.evaluateAll(now)
+			}
+		}
+	}()
+}
+
+func compileRule(rs *RuleSettings, dryRun bool) (*rule, error) {
+	if rs.Name == "" {
+		return nil, errors.New("missing name")
+	}
+
+	when, err := compileCondition(&rs.When)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, list := range [][]ActionSettings{rs.Actions, rs.OnClear} {
+		for _, a := range list {
+			switch a.Type {
+			case ActionLog, ActionMQTT, ActionWebhook, ActionAlert:
+			case ActionCoils:
+				if a.Coils == nil {
+					return nil, errors.New("coils action without 'coils' value")
+				}
+			default:
+				return nil, fmt.Errorf("unknown action type '%s'", a.Type)
+			}
+		}
+	}
+
+	return &rule{
+		name:         rs.Name,
+		devices:      rs.Devices,
+		when:         when,
+		holdFor:      time.Duration(rs.For),
+		actions:      rs.Actions,
+		clearActions: rs.OnClear,
+		dryRun:       dryRun || rs.DryRun,
+		instances:    map[uint16]*ruleInstance{},
+		queues:       map[uint16][]ruleRun{},
+	}, nil
+}
+
+func compileCondition(cs *ConditionSettings) (*condition, error) {
+	c := &condition{
+		above:      cs.Above,
+		below:      cs.Below,
+		hysteresis: cs.Hysteresis,
+		alert:      cs.Alert,
+		stale:      cs.Stale,
+	}
+
+	for _, child := range cs.All {
+		cc, err := compileCondition(&child)
+		if err != nil {
+			return nil, err
+		}
+		c.all = append(c.all, cc)
+	}
+
+	for _, child := range cs.Any {
+		cc, err := compileCondition(&child)
+		if err != nil {
+			return nil, err
+		}
+		c.any = append(c.any, cc)
+	}
+
+	if cs.Not != nil {
+		cc, err := compileCondition(cs.Not)
+		if err != nil {
+			return nil, err
+		}
+		c.not = cc
+	}
+
+	if cs.Sensor != "" {
+		t, ok := sensorTypeByName(cs.Sensor)
+		if !ok {
+			return nil, fmt.Errorf("unknown sensor type '%s'", cs.Sensor)
+		}
+		c.sensor = t
+		c.hasSensor = true
+	}
+
+	if cs.Time != nil {
+		from, err := parseTimeOfDay(cs.Time.From)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parseTimeOfDay(cs.Time.To)
+		if err != nil {
+			return nil, err
+		}
+		c.from = from
+		c.to = to
+		c.hasTime = true
+	}
+
+	kinds := 0
+	for _, set := range []bool{
+		len(c.all) > 0, len(c.any) > 0, c.not != nil,
+		c.above != nil || c.below != nil, c.alert != "", c.stale, c.hasTime,
+	} {
+		if set {
+			kinds++
+		}
+	}
+
+	switch {
+	case kinds != 1:
+		return nil, errors.New("condition must have exactly one of all, any, not, above/below, alert, stale or time")
+	case (c.above != nil || c.below != nil) && !c.hasSensor:
+		return nil, errors.New("threshold condition without sensor")
+	}
+
+	return c, nil
+}
+
+// parseTimeOfDay converts "HH:MM" to minutes since midnight
+func parseTimeOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day '%s'", s)
+	}
+
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (e *RulesEngine) evaluateAll(now time.Time) {
+	ids := map[uint16]bool{}
+	for _, id := range e.manager.DeviceIDs() {
+		ids[id] = true
+	}
+
+	// Include devices that have gone, so rules can react to that
+	e.lock.Lock()
+	for _, r := range e.rules {
+		for id := range r.instances {
+			ids[id] = true
+		}
+	}
+	e.lock.Unlock()
+
+	for id := range ids {
+		e.evaluateDevice(id, now)
+	}
+}
+
+func (e *RulesEngine) evaluateDevice(id uint16, now time.Time) {
+	d := e.manager.Snapshot(id)
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for _, r := range e.rules {
+		if !r.appliesTo(id) {
+			continue
+		}
+
+		inst, ok := r.instances[id]
+		if !ok {
+			if d == nil && len(r.devices) == 0 {
+				continue
+			}
+			inst = &ruleInstance{held: map[*condition]bool{}}
+			r.instances[id] = inst
+		}
+
+		trace := e.evaluateRule(r, inst, id, d, now)
+
+		r.traces = append(r.traces, trace)
+		if len(r.traces) > ruleTraceLength {
+			r.traces = r.traces[len(r.traces)-ruleTraceLength:]
+		}
+	}
+}
+
+// removeDevice drops the rule state of a forgotten or rejected device, once
+// its last evaluation has cleared any active rules
+func (e *RulesEngine) removeDevice(id uint16) {
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	for _, r := range e.rules {
+		delete(r.instances, id)
+	}
+}
+
+// evaluateRule updates a rule instance, running actions on transitions
+// unless the rule is in dry-run mode.  Must be called with the lock held.
+func (e *RulesEngine) evaluateRule(r *rule, inst *ruleInstance, id uint16, d *DeviceState, now time.Time) RuleTrace {
+	trace := RuleTrace{
+		Time:       now,
+		Rule:       r.name,
+		DeviceID:   id,
+		Conditions: []string{},
+		DryRun:     r.dryRun,
+	}
+
+	result := e.evaluate(r.when, inst, d, now, &trace.Conditions)
+	trace.Result = result
+
+	if !result {
+		inst.since = time.Time{}
+	} else if inst.since.IsZero() {
+		inst.since = now
+	}
+
+	var actions []ActionSettings
+	switch {
+	case result && !inst.active && now.Sub(inst.since) >= r.holdFor:
+		inst.active = true
+		trace.Transition = "raised"
+		actions = r.actions
+	case !result && inst.active:
+		inst.active = false
+		trace.Transition = "cleared"
+		actions = r.clearActions
+	}
+	trace.Active = inst.active
+
+	for _, a := range actions {
+		trace.Actions = append(trace.Actions, describeAction(&a))
+	}
+
+	if len(actions) > 0 {
+		if r.dryRun {
+			log.Printf("Rule '%s' %s for #%04x (dry-run): %v", r.name, trace.Transition, id, trace.Actions)
+		} else {
+			log.Printf("Rule '%s' %s for #%04x", r.name, trace.Transition, id)
+			e.queueActions(r, id, ruleRun{trace.Transition, actions})
+		}
+	}
+
+	return trace
+}
+
+// evaluate computes a condition, appending a description of each leaf to
+// the trace.  Children are always evaluated so hysteresis state stays
+// current.
+func (e *RulesEngine) evaluate(c *condition, inst *ruleInstance, d *DeviceState, now time.Time, trace *[]string) bool {
+	switch {
+	case len(c.all) > 0:
+		result := true
+		for _, cc := range c.all {
+			result = e.evaluate(cc, inst, d, now, trace) && result
+		}
+		return result
+	case len(c.any) > 0:
+		result := false
+		for _, cc := range c.any {
+			result = e.evaluate(cc, inst, d, now, trace) || result
+		}
+		return result
+	case c.not != nil:
+		return !e.evaluate(c.not, inst, d, now, trace)
+	case c.hasTime:
+		minutes := now.Hour()*60 + now.Minute()
+		result := minutes >= c.from && minutes < c.to
+		if c.from > c.to {
+			result = minutes >= c.from || minutes < c.to
+		}
+		*trace = append(*trace, fmt.Sprintf("time %02d:%02d in %02d:%02d-%02d:%02d: %v",
+			minutes/60, minutes%60, c.from/60, c.from%60, c.to/60, c.to%60, result))
+		return result
+	case c.stale:
+		result := d == nil
+		desc := "device gone"
+		if c.hasSensor {
+			md := sensorMetadata[c.sensor]
+			r, ok := d.reading(c.sensor)
+			result = !ok || r.Stale
+			desc = md.Name + " stale"
+		}
+		*trace = append(*trace, fmt.Sprintf("%s: %v", desc, result))
+		return result
+	case c.alert != "":
+		result := false
+		if d != nil {
+			for _, a := range d.alerts.Strings() {
+				result = result || a == c.alert || c.alert == "any"
+			}
+		}
+		*trace = append(*trace, fmt.Sprintf("alert %s: %v", c.alert, result))
+		return result
+	}
+
+	md := sensorMetadata[c.sensor]
+	r, ok := d.reading(c.sensor)
+	if !ok || r.Stale {
+		inst.held[c] = false
+		*trace = append(*trace, fmt.Sprintf("%s: no fresh reading", md.Name))
+		return false
+	}
+
+	// While held, the thresholds are relaxed by the hysteresis so the
+	// condition doesn't flap around the threshold
+	held := inst.held[c]
+	v := e.manager.Units().Quantity(md, r.Value).Value
+	result := true
+	desc := fmt.Sprintf("%s=%.2f", md.Name, v)
+
+	if c.above != nil {
+		limit := *c.above
+		if held {
+			limit -= c.hysteresis
+		}
+		result = result && v > limit
+		desc += fmt.Sprintf(" >%.2f", limit)
+	}
+	if c.below != nil {
+		limit := *c.below
+		if held {
+			limit += c.hysteresis
+		}
+		result = result && v < limit
+		desc += fmt.Sprintf(" <%.2f", limit)
+	}
+
+	inst.held[c] = result
+	*trace = append(*trace, fmt.Sprintf("%s: %v", desc, result))
+
+	return result
+}
+
+func (r *rule) appliesTo(id uint16) bool {
+	if len(r.devices) == 0 {
+		return true
+	}
+
+	for _, d := range r.devices {
+		if d == id {
+			return true
+		}
+	}
+
+	return false
+}
+
+// queueActions runs the actions of a transition after any earlier ones for
+// the same rule and device.  Must be called with the lock held.
+func (e *RulesEngine) queueActions(r *rule, id uint16, run ruleRun) {
+	queue, running := r.queues[id]
+	r.queues[id] = append(queue, run)
+
+	if !running {
+		go e.drainActions(r, id)
+	}
+}
+
+// drainActions runs the queued actions of a rule and device until none are
+// left
+func (e *RulesEngine) drainActions(r *rule, id uint16) {
+	for {
+		e.lock.Lock()
+		queue := r.queues[id]
+		if len(queue) == 0 {
+			delete(r.queues, id)
+			e.lock.Unlock()
+			return
+		}
+		r.queues[id] = queue[1:]
+		e.lock.Unlock()
+
+		e.runActions(r.name, queue[0].transition, id, queue[0].actions)
+	}
+}
+
+func (e *RulesEngine) runActions(ruleName string, transition string, id uint16, actions []ActionSettings) {
+	expand := strings.NewReplacer(
+		"{rule}", ruleName,
+		"{device}", strconv.Itoa(int(id)),
+		"{event}", transition,
+	).Replace
+
+	for _, a := range actions {
+		var err error
+
+		switch a.Type {
+		case ActionLog:
+			log.Printf("Rule '%s': %s", ruleName, expand(a.Message))
+		case ActionMQTT:
+			if e.publish == nil {
+				err = errors.New("mqtt not available")
+				break
+			}
+			err = e.publish(expand(a.Topic), expand(a.Payload))
+		case ActionWebhook:
+			err = e.callWebhook(expand(a.URL), ruleName, transition, id)
+		case ActionCoils:
+			target := id
+			if a.Device != nil {
+				target = *a.Device
+			}
+			err = e.downlink.Queue(target, ConfigCoils, *a.Coils)
+		case ActionAlert:
+			name := expand(a.Alert)
+			if name == "" {
+				name = fmt.Sprintf("rule:%s:%d", ruleName, id)
+			}
+
+			// Alerts follow the rule, so raising actions raise the alert
+			// and clearing actions clear it
+			if transition == "cleared" {
+				e.manager.ControllerAlerts().Clear(name)
+			} else {
+				e.manager.ControllerAlerts().Raise(name, expand(a.Message))
+			}
+		}
+
+		if err != nil {
+			log.Printf("Rule '%s': %s action failed: %v", ruleName, a.Type, err)
+		}
+	}
+}
+
+func (e *RulesEngine) callWebhook(url string, ruleName string, transition string, id uint16) error {
+	body, err := json.Marshal(struct {
+		Rule     string
+		DeviceID uint16
+		Event    string
+		Time     time.Time
+	}{ruleName, id, transition, time.Now()})
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.httpClient.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook returned %s", resp.Status)
+	}
+
+	return nil
+}
+
+func describeAction(a *ActionSettings) string {
+	switch a.Type {
+	case ActionMQTT:
+		return fmt.Sprintf("mqtt %s", a.Topic)
+	case ActionWebhook:
+		return fmt.Sprintf("webhook %s", a.URL)
+	case ActionCoils:
+		return fmt.Sprintf("coils %#04x", *a.Coils)
+	case ActionAlert:
+		return fmt.Sprintf("alert %s", a.Alert)
+	}
+
+	return a.Type
+}
+
+type jsonRuleState struct {
+	Name   string
+	DryRun bool
+	Active []uint16
+}
+
+// handleRules serves GET /api/rules, the devices each rule is active for
+func (e *RulesEngine) handleRules(w http.ResponseWriter, r *http.Request) {
+	e.lock.Lock()
+	result := []jsonRuleState{}
+	for _, rl := range e.rules {
+		state := jsonRuleState{Name: rl.name, DryRun: rl.dryRun, Active: []uint16{}}
+		for id, inst := range rl.instances {
+			if inst.active {
+				state.Active = append(state.Active, id)
+			}
+		}
+		sort.Slice(state.Active, func(i, j int) bool { return state.Active[i] < state.Active[j] })
+		result = append(result, state)
+	}
+	e.lock.Unlock()
+
+	writeJSON(w, result)
+}
+
+// handleRule serves:
+//
+//	GET  /api/rules/{name}/trace
+//	POST /api/rules/{name}/test?device={id}
+//
+// Testing evaluates the rule against the current device state without
+// changing rule state or running actions.
+func (e *RulesEngine) handleRule(w http.ResponseWriter, r *http.Request) {
+	name, action, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/rules/"), "/")
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+
+	var rl *rule
+	for _, candidate := range e.rules {
+		if candidate.name == name {
+			rl = candidate
+		}
+	}
+	if rl == nil {
+		http.Error(w, ErrUnknownRule.Error(), http.StatusNotFound)
+		return
+	}
+
+	switch {
+	case action == "trace" && r.Method == http.MethodGet:
+		writeJSON(w, rl.traces)
+	case action == "test" && r.Method == http.MethodPost:
+		id, err := strconv.ParseUint(r.URL.Query().Get("device"), 10, 16)
+		if err != nil {
+			http.Error(w, "invalid device id", http.StatusBadRequest)
+			return
+		}
+
+		// Evaluate against a copy of the instance state
+		inst := &ruleInstance{held: map[*condition]bool{}}
+		if existing, ok := rl.instances[uint16(id)]; ok {
+			inst.active = existing.active
+			inst.since = existing.since
+			for k, v := range existing.held {
+				inst.held[k] = v
+			}
+		}
+
+		test := *rl
+		test.dryRun = true
+		writeJSON(w, e.evaluateRule(&test, inst, uint16(id), e.manager.Snapshot(uint16(id)), time.Now()))
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/netleapio/zappy-framework/protocol"
+)
+
+func newTestRules(t *testing.T, publish MQTTPublisher) (*RulesEngine, *DeviceManager) {
+	t.Helper()
+
+	mgr, err := NewDeviceManager(&Config{Registry: filepath.Join(t.TempDir(), "registry.json")})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	above := 25.0
+	e, err := NewRulesEngine(&RulesSettings{Rules: []RuleSettings{{
+		Name:    "hot",
+		When:    ConditionSettings{Sensor: "temperature", Above: &above},
+		Actions: []ActionSettings{{Type: ActionMQTT, Topic: "hot", Payload: "{event}"}},
+		OnClear: []ActionSettings{{Type: ActionMQTT, Topic: "hot", Payload: "{event}"}},
+	}}}, NewDownlink(NetworkID, &DownlinkSettings{}, mgr.Events()), publish)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.Init(mgr, NetworkID)
+
+	return e, mgr
+}
+
+// setTemperature sets the temperature reading of a device
+func setTemperature(mgr *DeviceManager, id uint16, v float64) {
+	mgr.doLocked(func() error {
+		now := time.Now()
+		mgr.devices[id] = &DeviceState{
+			id:       id,
+			lastSeen: now,
+			sensors:  map[protocol.SensorType]Reading{protocol.SensorTypeTemperature: {Value: v, Received: now}},
+		}
+		return nil
+	})
+}
+
+func TestRuleActionsRunInOrder(t *testing.T) {
+	lock := sync.Mutex{}
+	published := []string{}
+	e, mgr := newTestRules(t, func(topic string, payload string) error {
+		lock.Lock()
+		first := len(published) == 0
+		lock.Unlock()
+
+		// A slow first action must not let later transitions overtake it
+		if first {
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		lock.Lock()
+		published = append(published, payload)
+		lock.Unlock()
+		return nil
+	})
+
+	for _, v := range []float64{30, 20, 30, 20} {
+		setTemperature(mgr, 1, v)
+		e.evaluateDevice(1, time.Now())
+	}
+
+	want := "raised cleared raised cleared"
+	waitFor(t, "actions", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(published) == 4
+	})
+	if got := strings.Join(published, " "); got != want {
+		t.Errorf("actions ran as %q, want %q", got, want)
+	}
+}
+
+func TestRuleInstancesRemovedWithDevice(t *testing.T) {
+	lock := sync.Mutex{}
+	published := []string{}
+	e, mgr := newTestRules(t, func(topic string, payload string) error {
+		lock.Lock()
+		defer lock.Unlock()
+		published = append(published, payload)
+		return nil
+	})
+
+	setTemperature(mgr, 1, 30)
+	e.evaluateDevice(1, time.Now())
+
+	// Forgetting the device clears the rule before its state is dropped
+	err := mgr.Forget(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e.evaluateDevice(1, time.Now())
+	e.removeDevice(1)
+
+	waitFor(t, "actions", func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(published) == 2
+	})
+	if got := strings.Join(published, " "); got != "raised cleared" {
+		t.Errorf("actions ran as %q", got)
+	}
+
+	e.lock.Lock()
+	defer e.lock.Unlock()
+	if n := len(e.rules[0].instances); n != 0 {
+		t.Errorf("%d rule instances left", n)
+	}
+}
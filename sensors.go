@@ -0,0 +1,58 @@
+package main
+
+import "github.com/netleapio/zappy-framework/protocol"
+
+// Sensor types for readings derived by the controller rather than sent by
+// devices.  These start at 0x80 to leave room for protocol sensor types.
+const (
+	SensorTypeDewPoint protocol.SensorType = 0x80 + iota
+	SensorTypeAbsoluteHumidity
+	SensorTypeHeatIndex
+	SensorTypeSeaLevelPressure
+)
+
+// sensorMetadata holds the metadata of all protocol and derived sensor
+// types.  Derived sensors are already in SI units so Mult and Div are 1.
+var sensorMetadata = initSensorMetadata()
+
+func initSensorMetadata() map[protocol.SensorType]*protocol.SensorInfo {
+	result := map[protocol.SensorType]*protocol.SensorInfo{}
+
+	for t, md := range protocol.SensorMetadata {
+		result[t] = md
+	}
+
+	for _, ds := range derivedSensors {
+		result[ds.Type()] = ds.Info()
+	}
+
+	for t, md := range zoneSensorMetadata {
+		result[t] = md
+	}
+
+	for t, md := range batterySensorMetadata {
+		result[t] = md
+	}
+
+	for t, md := range trafficSensorMetadata {
+		result[t] = md
+	}
+
+	return result
+}
+
+// sensorTypeByName finds the sensor type with the given metadata name
+func sensorTypeByName(name string) (protocol.SensorType, bool) {
+	for t, md := range sensorMetadata {
+		if md.Name == name {
+			return t, true
+		}
+	}
+
+	return 0, false
+}
+
+// sensorValue converts a protocol value to SI units
+func sensorValue(md *protocol.SensorInfo, raw uint16) float64 {
+	return float64(raw) * float64(md.Mult) / float64(md.Div)
+}
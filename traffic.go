@@ -0,0 +1,169 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"time"
+
+	"github.com/netleapio/zappy-framework/protocol"
+)
+
+// Sensor types for link health
+const (
+	SensorTypePacketLoss protocol.SensorType = 0xB0 + iota
+	SensorTypeReportInterval
+	SensorTypeReportJitter
+)
+
+var trafficSensorMetadata = map[protocol.SensorType]*protocol.SensorInfo{
+	SensorTypePacketLoss:     {Name: "packet_loss", Unit: "percent", Mult: 1, Div: 1},
+	SensorTypeReportInterval: {Name: "report_interval", Unit: "seconds", Mult: 1, Div: 1},
+	SensorTypeReportJitter:   {Name: "report_jitter", Unit: "seconds", Mult: 1, Div: 1},
+}
+
+const (
+	// trafficSmoothing is the weight of each new interval in the mean and
+	// jitter, as for RTP interarrival jitter
+	trafficSmoothing = 1.0 / 16
+
+	// duplicateWindow within which an identical packet is a retransmission
+	duplicateWindow = DeviceUpdatePeriod / 2
+
+	maxVersionHistory = 10
+)
+
+// VersionChange records when a device was first seen with a firmware
+// version
+type VersionChange struct {
+	Version uint16
+	Seen    time.Time
+}
+
+// TrafficStats summarises the packets received from a device
+type TrafficStats struct {
+	FirstSeen      time.Time
+	LastSeen       time.Time
+	Packets        uint64
+	Duplicates     uint64
+	DecodeFailures uint64
+
+	// IntervalMean and IntervalJitter of reports, in seconds
+	IntervalMean   float64
+	IntervalJitter float64
+
+	// PacketLoss is the percentage of reports not received, given the
+	// expected interval of the device's profile
+	PacketLoss float64
+
+	Versions []VersionChange
+}
+
+// trafficState is kept across device timeouts, so a device that drops
+// out for a while shows up in its loss
+type trafficState struct {
+	stats      TrafficStats
+	intervals  uint64
+	lastPacket []byte
+}
+
+// updateTraffic records a packet from a device, returning false if it is
+// a duplicate that should be ignored.  Must be called with the lock held.
+func (m *DeviceManager) updateTraffic(d *DeviceState, pkt *protocol.Packet, now time.Time) bool {
+	t, ok := m.traffic[d.id]
+	if !ok {
+		t = &trafficState{stats: TrafficStats{FirstSeen: now}}
+		m.traffic[d.id] = t
+	}
+	s := &t.stats
+
+	if !s.LastSeen.IsZero() && now.Sub(s.LastSeen) < duplicateWindow && bytes.Equal(t.lastPacket, pkt.AsBytes()) {
+		s.Duplicates++
+		return false
+	}
+
+	if !s.LastSeen.IsZero() {
+		interval := now.Sub(s.LastSeen).Seconds()
+		if t.intervals == 0 {
+			s.IntervalMean = interval
+		} else {
+			diff := interval - s.IntervalMean
+			s.IntervalMean += trafficSmoothing * diff
+			s.IntervalJitter += trafficSmoothing * (math.Abs(diff) - s.IntervalJitter)
+		}
+		t.intervals++
+	}
+
+	s.Packets++
+	s.LastSeen = now
+	t.lastPacket = append(t.lastPacket[:0], pkt.AsBytes()...)
+
+	n := len(s.Versions)
+	if n == 0 || s.Versions[n-1].Version != pkt.Version() {
+		s.Versions = appendWindow(s.Versions, VersionChange{Version: pkt.Version(), Seen: now}, maxVersionHistory)
+	}
+
+	period := m.profileFor(d).ExpectedInterval
+	expected := math.Floor(s.LastSeen.Sub(s.FirstSeen).Seconds()/period.Seconds()) + 1
+	s.PacketLoss = math.Max(0, 100*(1-float64(s.Packets)/expected))
+
+	d.sensors[SensorTypePacketLoss] = Reading{Value: s.PacketLoss, Received: now}
+	if t.intervals > 0 {
+		d.sensors[SensorTypeReportInterval] = Reading{Value: s.IntervalMean, Received: now}
+		d.sensors[SensorTypeReportJitter] = Reading{Value: s.IntervalJitter, Received: now}
+	}
+
+	return true
+}
+
+// DecodeFailure counts a packet that failed its CRC check.  The device ID
+// of a corrupt packet cannot be trusted, so failures are only attributed
+// to devices already known.
+func (m *DeviceManager) DecodeFailure(id uint16) {
+	m.doLocked(func() error {
+		if t, ok := m.traffic[id]; ok {
+			t.stats.DecodeFailures++
+		} else {
+			m.decodeFailures++
+		}
+		return nil
+	})
+}
+
+// TrafficStats gets the traffic statistics of a device
+func (m *DeviceManager) TrafficStats(id uint16) (TrafficStats, bool) {
+	result := TrafficStats{}
+	found := false
+
+	m.doLocked(func() error {
+		t, ok := m.traffic[id]
+		if !ok {
+			return nil
+		}
+
+		found = true
+		result = t.stats
+		result.Versions = append([]VersionChange(nil), t.stats.Versions...)
+		return nil
+	})
+
+	return result, found
+}
+
+// AllTrafficStats gets the traffic statistics of every device seen, and
+// the number of corrupt packets from unknown devices
+func (m *DeviceManager) AllTrafficStats() (map[uint16]TrafficStats, uint64) {
+	result := map[uint16]TrafficStats{}
+	unattributed := uint64(0)
+
+	m.doLocked(func() error {
+		for id, t := range m.traffic {
+			s := t.stats
+			s.Versions = append([]VersionChange(nil), t.stats.Versions...)
+			result[id] = s
+		}
+		unattributed = m.decodeFailures
+		return nil
+	})
+
+	return result, unattributed
+}
@@ -0,0 +1,133 @@
+package tsdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"time"
+)
+
+// Tier identifies one level of rollup resolution.
+type Tier int
+
+const (
+	TierMinute Tier = iota
+	TierHour
+	TierDay
+
+	numTiers = 3
+)
+
+var tierInfo = [numTiers]struct {
+	name       string
+	resolution time.Duration
+	segment    time.Duration
+}{
+	{name: "1m", resolution: time.Minute, segment: 24 * time.Hour},
+	{name: "1h", resolution: time.Hour, segment: 30 * 24 * time.Hour},
+	{name: "1d", resolution: 24 * time.Hour, segment: 365 * 24 * time.Hour},
+}
+
+// AllTiers lists the tiers from finest to coarsest resolution
+var AllTiers = []Tier{TierMinute, TierHour, TierDay}
+
+var ErrUnknownTier = errors.New("unknown tier")
+
+// ParseTier converts a tier name ("1m", "1h" or "1d") to a Tier
+func ParseTier(s string) (Tier, error) {
+	for t, info := range tierInfo {
+		if info.name == s {
+			return Tier(t), nil
+		}
+	}
+
+	return 0, fmt.Errorf("%w: %q", ErrUnknownTier, s)
+}
+
+func (t Tier) String() string {
+	return tierInfo[t].name
+}
+
+// Resolution is the period covered by each bucket in the tier
+func (t Tier) Resolution() time.Duration {
+	return tierInfo[t].resolution
+}
+
+// Bucket holds the aggregate of all samples that fall within one
+// resolution period of a tier.
+type Bucket struct {
+	Start time.Time
+	Min   float64
+	Max   float64
+	Sum   float64
+	Count uint32
+}
+
+func (b *Bucket) Mean() float64 {
+	if b.Count == 0 {
+		return 0
+	}
+
+	return b.Sum / float64(b.Count)
+}
+
+func (b *Bucket) add(v float64) {
+	b.merge(Bucket{Min: v, Max: v, Sum: v, Count: 1})
+}
+
+func (b *Bucket) merge(o Bucket) {
+	if o.Count == 0 {
+		return
+	}
+
+	if b.Count == 0 {
+		b.Min = o.Min
+		b.Max = o.Max
+	} else {
+		b.Min = math.Min(b.Min, o.Min)
+		b.Max = math.Max(b.Max, o.Max)
+	}
+
+	b.Sum += o.Sum
+	b.Count += o.Count
+}
+
+//
+//   Record Format (big-endian, fixed size)
+//
+//   0        8        16       24       32      36    40
+//   +--------+--------+--------+--------+-------+-----+
+//   | Start  | Min    | Max    | Sum    | Count | CRC |
+//   +--------+--------+--------+--------+-------+-----+
+//
+//   Start is unix seconds, Min/Max/Sum are IEEE-754 doubles and the
+//   CRC is CRC-32 (IEEE) of the preceding 36 bytes.  A record with a bad
+//   CRC marks the end of the valid data in a segment (torn write).
+//
+
+const recordLen = 40
+
+func encodeRecord(buf []byte, b *Bucket) {
+	binary.BigEndian.PutUint64(buf[0:], uint64(b.Start.Unix()))
+	binary.BigEndian.PutUint64(buf[8:], math.Float64bits(b.Min))
+	binary.BigEndian.PutUint64(buf[16:], math.Float64bits(b.Max))
+	binary.BigEndian.PutUint64(buf[24:], math.Float64bits(b.Sum))
+	binary.BigEndian.PutUint32(buf[32:], b.Count)
+	binary.BigEndian.PutUint32(buf[36:], crc32.ChecksumIEEE(buf[:36]))
+}
+
+func decodeRecord(buf []byte) (Bucket, bool) {
+	if binary.BigEndian.Uint32(buf[36:]) != crc32.ChecksumIEEE(buf[:36]) {
+		return Bucket{}, false
+	}
+
+	return Bucket{
+		Start: time.Unix(int64(binary.BigEndian.Uint64(buf[0:])), 0).UTC(),
+		Min:   math.Float64frombits(binary.BigEndian.Uint64(buf[8:])),
+		Max:   math.Float64frombits(binary.BigEndian.Uint64(buf[16:])),
+		Sum:   math.Float64frombits(binary.BigEndian.Uint64(buf[24:])),
+		Count: binary.BigEndian.Uint32(buf[32:]),
+	}, true
+}
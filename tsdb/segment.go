@@ -0,0 +1,156 @@
+package tsdb
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const segmentExt = ".seg"
+
+// segmentStart returns the start of the segment that holds buckets
+// starting at t
+func segmentStart(tier Tier, t time.Time) time.Time {
+	return t.Truncate(tierInfo[tier].segment).UTC()
+}
+
+func segmentPath(dir string, tier Tier, start time.Time) string {
+	return filepath.Join(dir, tier.String(), strconv.FormatInt(start.Unix(), 10)+segmentExt)
+}
+
+// listSegments returns the start times of all segments of a tier, oldest
+// first
+func listSegments(dir string, tier Tier) ([]time.Time, error) {
+	entries, err := os.ReadDir(filepath.Join(dir, tier.String()))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	result := []time.Time{}
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		secs, err := strconv.ParseInt(strings.TrimSuffix(name, segmentExt), 10, 64)
+		if err != nil {
+			continue
+		}
+
+		result = append(result, time.Unix(secs, 0).UTC())
+	}
+
+	sort.Slice(result, func(i, j int) bool { return result[i].Before(result[j]) })
+
+	return result, nil
+}
+
+// readSegment reads the valid records of a segment, returning them with
+// the length of the valid prefix of the file.  Reading stops at the first
+// short or corrupt record.
+func readSegment(path string) ([]Bucket, int64, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	result := make([]Bucket, 0, len(data)/recordLen)
+	valid := int64(0)
+	for len(data) >= recordLen {
+		b, ok := decodeRecord(data[:recordLen])
+		if !ok {
+			break
+		}
+
+		result = append(result, b)
+		data = data[recordLen:]
+		valid += recordLen
+	}
+
+	return result, valid, nil
+}
+
+// segmentWriter appends records to the current segment of one tier
+// of a series
+type segmentWriter struct {
+	dir   string
+	tier  Tier
+	f     *os.File
+	start time.Time
+	buf   [recordLen]byte
+}
+
+func (w *segmentWriter) append(b *Bucket) error {
+	start := segmentStart(w.tier, b.Start)
+
+	if w.f == nil || !w.start.Equal(start) {
+		err := w.open(start)
+		if err != nil {
+			return err
+		}
+	}
+
+	encodeRecord(w.buf[:], b)
+
+	_, err := w.f.Write(w.buf[:])
+	if err != nil {
+		return err
+	}
+
+	return w.f.Sync()
+}
+
+// open switches to the segment starting at 'start', discarding any torn
+// record left at the end of it by an earlier crash
+func (w *segmentWriter) open(start time.Time) error {
+	w.close()
+
+	path := segmentPath(w.dir, w.tier, start)
+
+	err := os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return err
+	}
+
+	_, valid, err := readSegment(path)
+	if err == nil {
+		err = f.Truncate(valid)
+	}
+	if err == nil {
+		_, err = f.Seek(valid, io.SeekStart)
+	}
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("repairing segment %s: %w", path, err)
+	}
+
+	w.f = f
+	w.start = start
+
+	return nil
+}
+
+func (w *segmentWriter) close() error {
+	if w.f == nil {
+		return nil
+	}
+
+	err := w.f.Close()
+	w.f = nil
+	return err
+}
@@ -0,0 +1,462 @@
+package tsdb
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidName = errors.New("invalid series name")
+	ErrOutOfOrder  = errors.New("sample is older than the current bucket")
+	ErrNotFound    = errors.New("series not found")
+)
+
+// Store is an embedded, append-only time-series store.
+//
+// Each series is kept in its own directory with one sub-directory of
+// segment files per tier.  Samples are aggregated into one minute buckets
+// which are rolled up into hourly and daily buckets as each period
+// completes.
+//
+// Only complete buckets are written, so at most the current minute of
+// samples is lost if the process dies.  Incomplete hourly and daily
+// buckets are rebuilt from the finer tiers when a series is re-opened.
+type Store struct {
+	dir       string
+	lock      sync.Mutex
+	series    map[string]*series
+	retention [numTiers]time.Duration
+}
+
+type series struct {
+	dir       string
+	committed time.Time
+	open      [numTiers]*Bucket
+	writers   [numTiers]segmentWriter
+}
+
+// Open opens (or creates) a store in the given directory
+func Open(dir string) (*Store, error) {
+	err := os.MkdirAll(dir, 0755)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Store{
+		dir:    dir,
+		series: map[string]*series{},
+	}, nil
+}
+
+// SetRetention sets how long buckets of a tier are kept.  Zero means
+// forever.
+func (s *Store) SetRetention(tier Tier, d time.Duration) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.retention[tier] = d
+}
+
+// Append adds a sample to a series.  Samples must be appended in time
+// order, although any number may share the same minute.
+func (s *Store) Append(name string, t time.Time, v float64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sr, err := s.getSeries(name)
+	if err != nil {
+		return err
+	}
+
+	start := t.Truncate(TierMinute.Resolution()).UTC()
+
+	open := sr.open[TierMinute]
+	if open == nil && !sr.committed.IsZero() && !start.After(sr.committed) {
+		return ErrOutOfOrder
+	} else if open != nil && start.Before(open.Start) {
+		return ErrOutOfOrder
+	}
+
+	if open != nil && start.After(open.Start) {
+		err = sr.commit(TierMinute, *open)
+		if err != nil {
+			return err
+		}
+		sr.open[TierMinute] = nil
+	}
+
+	if sr.open[TierMinute] == nil {
+		sr.open[TierMinute] = &Bucket{Start: start}
+	}
+	sr.open[TierMinute].add(v)
+
+	return nil
+}
+
+// Flush writes any minute bucket whose period ended before 'now', so
+// series that stop receiving samples are still persisted.
+func (s *Store) Flush(now time.Time) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var result error
+	for name, sr := range s.series {
+		open := sr.open[TierMinute]
+		if open == nil || open.Start.Add(TierMinute.Resolution()).After(now) {
+			continue
+		}
+
+		err := sr.commit(TierMinute, *open)
+		if err != nil {
+			result = fmt.Errorf("flushing %s: %w", name, err)
+			continue
+		}
+		sr.open[TierMinute] = nil
+	}
+
+	return result
+}
+
+// Query returns the buckets of a tier that start within [from, to),
+// including the incomplete bucket currently being aggregated.  A zero
+// 'to' means no upper bound.
+func (s *Store) Query(name string, tier Tier, from time.Time, to time.Time) ([]Bucket, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	sr, err := s.findSeries(name)
+	if err != nil {
+		return nil, err
+	}
+
+	result, err := sr.read(tier, from, to)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, b := range sr.pending(tier) {
+		if !b.Start.Before(from) && (to.IsZero() || b.Start.Before(to)) {
+			result = append(result, b)
+		}
+	}
+
+	return result, nil
+}
+
+// Series lists the names of all series in the store
+func (s *Store) Series() ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []string{}
+	for _, e := range entries {
+		if e.IsDir() && validName(e.Name()) {
+			result = append(result, e.Name())
+		}
+	}
+
+	return result, nil
+}
+
+// Prune deletes segments that fall entirely outside the retention period
+// of their tier
+func (s *Store) Prune(now time.Time) error {
+	names, err := s.Series()
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	for _, name := range names {
+		dir := filepath.Join(s.dir, name)
+
+		for _, tier := range AllTiers {
+			retention := s.retention[tier]
+			if retention == 0 {
+				continue
+			}
+
+			segments, err := listSegments(dir, tier)
+			if err != nil {
+				return err
+			}
+
+			cutoff := now.Add(-retention)
+			for _, start := range segments {
+				if start.Add(tierInfo[tier].segment).After(cutoff) {
+					break
+				}
+
+				sr, ok := s.series[name]
+				if ok && sr.writers[tier].f != nil && sr.writers[tier].start.Equal(start) {
+					sr.writers[tier].close()
+				}
+
+				err = os.Remove(segmentPath(dir, tier, start))
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// Close releases all open segment files.  Incomplete buckets are not
+// written.
+func (s *Store) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var result error
+	for _, sr := range s.series {
+		for t := range sr.writers {
+			err := sr.writers[t].close()
+			if err != nil {
+				result = err
+			}
+		}
+	}
+
+	s.series = map[string]*series{}
+
+	return result
+}
+
+// findSeries gets a series that has been appended to or written to disk,
+// without creating it
+func (s *Store) findSeries(name string) (*series, error) {
+	if !validName(name) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	if sr, ok := s.series[name]; ok {
+		return sr, nil
+	}
+
+	_, err := os.Stat(filepath.Join(s.dir, name))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("%w: %q", ErrNotFound, name)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return s.getSeries(name)
+}
+
+func (s *Store) getSeries(name string) (*series, error) {
+	if !validName(name) {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	sr, ok := s.series[name]
+	if ok {
+		return sr, nil
+	}
+
+	sr = &series{dir: filepath.Join(s.dir, name)}
+	for _, t := range AllTiers {
+		sr.writers[t] = segmentWriter{dir: sr.dir, tier: t}
+	}
+
+	err := sr.recover()
+	if err != nil {
+		return nil, fmt.Errorf("recovering %s: %w", name, err)
+	}
+
+	s.series[name] = sr
+
+	return sr, nil
+}
+
+// recover rebuilds the incomplete bucket of each tier by replaying the
+// records of the next finer tier that have not yet been rolled up.
+//
+// Coarsest tiers are recovered first, so buckets committed while replaying
+// a finer tier are rolled up exactly once.
+func (sr *series) recover() error {
+	last, err := sr.lastRecord(TierMinute)
+	if err != nil {
+		return err
+	}
+	if last != nil {
+		sr.committed = last.Start
+	}
+
+	for tier := Tier(numTiers - 1); tier > TierMinute; tier-- {
+		from := time.Time{}
+
+		last, err := sr.lastRecord(tier)
+		if err != nil {
+			return err
+		}
+		if last != nil {
+			from = last.Start.Add(tier.Resolution())
+		}
+
+		records, err := sr.read(tier-1, from, time.Time{})
+		if err != nil {
+			return err
+		}
+
+		for _, b := range records {
+			err = sr.rollup(tier, b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// commit writes a complete bucket and rolls it up into the next tier
+func (sr *series) commit(tier Tier, b Bucket) error {
+	err := sr.writers[tier].append(&b)
+	if err != nil {
+		return err
+	}
+
+	if tier == TierMinute {
+		sr.committed = b.Start
+	}
+
+	if tier+1 < numTiers {
+		return sr.rollup(tier+1, b)
+	}
+
+	return nil
+}
+
+// rollup merges a complete bucket from the next finer tier into the
+// current bucket of 'tier', committing that first if the period has moved
+// on
+func (sr *series) rollup(tier Tier, b Bucket) error {
+	start := b.Start.Truncate(tier.Resolution()).UTC()
+
+	open := sr.open[tier]
+	if open != nil && !open.Start.Equal(start) {
+		err := sr.commit(tier, *open)
+		if err != nil {
+			return err
+		}
+		sr.open[tier] = nil
+	}
+
+	if sr.open[tier] == nil {
+		sr.open[tier] = &Bucket{Start: start}
+	}
+	sr.open[tier].merge(b)
+
+	return nil
+}
+
+// pending returns the not-yet-written buckets of a tier, including the
+// contribution of incomplete buckets from finer tiers
+func (sr *series) pending(tier Tier) []Bucket {
+	byStart := map[int64]*Bucket{}
+
+	for t := TierMinute; t <= tier; t++ {
+		open := sr.open[t]
+		if open == nil {
+			continue
+		}
+
+		b := *open
+		b.Start = b.Start.Truncate(tier.Resolution()).UTC()
+
+		existing, ok := byStart[b.Start.Unix()]
+		if ok {
+			existing.merge(b)
+		} else {
+			byStart[b.Start.Unix()] = &b
+		}
+	}
+
+	result := make([]Bucket, 0, len(byStart))
+	for _, b := range byStart {
+		result = append(result, *b)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Start.Before(result[j].Start) })
+
+	return result
+}
+
+// read returns the stored buckets of a tier that start within [from, to)
+func (sr *series) read(tier Tier, from time.Time, to time.Time) ([]Bucket, error) {
+	segments, err := listSegments(sr.dir, tier)
+	if err != nil {
+		return nil, err
+	}
+
+	result := []Bucket{}
+	for _, start := range segments {
+		if !start.Add(tierInfo[tier].segment).After(from) {
+			continue
+		}
+		if !to.IsZero() && !start.Before(to) {
+			break
+		}
+
+		records, _, err := readSegment(segmentPath(sr.dir, tier, start))
+		if err != nil {
+			return nil, err
+		}
+
+		for _, b := range records {
+			if !b.Start.Before(from) && (to.IsZero() || b.Start.Before(to)) {
+				result = append(result, b)
+			}
+		}
+	}
+
+	return result, nil
+}
+
+func (sr *series) lastRecord(tier Tier) (*Bucket, error) {
+	segments, err := listSegments(sr.dir, tier)
+	if err != nil {
+		return nil, err
+	}
+
+	for i := len(segments) - 1; i >= 0; i-- {
+		records, _, err := readSegment(segmentPath(sr.dir, tier, segments[i]))
+		if err != nil {
+			return nil, err
+		}
+
+		if len(records) > 0 {
+			return &records[len(records)-1], nil
+		}
+	}
+
+	return nil, nil
+}
+
+func validName(name string) bool {
+	if name == "" || name == "." || name == ".." {
+		return false
+	}
+
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+		case r == '_', r == '-', r == '.':
+		default:
+			return false
+		}
+	}
+
+	return true
+}
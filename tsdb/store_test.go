@@ -0,0 +1,339 @@
+package tsdb
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var t0 = time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+type sample struct {
+	at time.Duration
+	v  float64
+}
+
+func bucket(at time.Duration, min, max, sum float64, count uint32) Bucket {
+	return Bucket{Start: t0.Add(at), Min: min, Max: max, Sum: sum, Count: count}
+}
+
+func openStore(t *testing.T, dir string) *Store {
+	t.Helper()
+
+	s, err := Open(dir)
+	if err != nil {
+		t.Fatalf("Open: %v", err)
+	}
+
+	return s
+}
+
+func appendSamples(t *testing.T, s *Store, name string, samples []sample) {
+	t.Helper()
+
+	for _, smp := range samples {
+		err := s.Append(name, t0.Add(smp.at), smp.v)
+		if err != nil {
+			t.Fatalf("Append at %v: %v", smp.at, err)
+		}
+	}
+}
+
+func query(t *testing.T, s *Store, name string, tier Tier) []Bucket {
+	t.Helper()
+
+	result, err := s.Query(name, tier, time.Time{}, time.Time{})
+	if err != nil {
+		t.Fatalf("Query %v: %v", tier, err)
+	}
+
+	return result
+}
+
+var rollupSamples = []sample{
+	{10 * time.Second, 1},
+	{20 * time.Second, 3},
+	{70 * time.Second, 5},
+	{61 * time.Minute, 7},
+}
+
+var rollupTests = []struct {
+	tier Tier
+	want []Bucket
+}{
+	{TierMinute, []Bucket{
+		bucket(0, 1, 3, 4, 2),
+		bucket(time.Minute, 5, 5, 5, 1),
+		bucket(61*time.Minute, 7, 7, 7, 1),
+	}},
+	{TierHour, []Bucket{
+		bucket(0, 1, 5, 9, 3),
+		bucket(time.Hour, 7, 7, 7, 1),
+	}},
+	{TierDay, []Bucket{
+		bucket(0, 1, 7, 16, 4),
+	}},
+}
+
+func TestAppendFlushRollup(t *testing.T) {
+	dir := t.TempDir()
+
+	s := openStore(t, dir)
+	appendSamples(t, s, "a", rollupSamples)
+
+	err := s.Flush(t0.Add(63 * time.Minute))
+	if err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	for _, tt := range rollupTests {
+		got := query(t, s, "a", tt.tier)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tier %v: got %v, want %v", tt.tier, got, tt.want)
+		}
+	}
+
+	// The incomplete hourly and daily buckets are rebuilt on reopening
+	err = s.Close()
+	if err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	s = openStore(t, dir)
+	defer s.Close()
+
+	for _, tt := range rollupTests {
+		got := query(t, s, "a", tt.tier)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("reopened tier %v: got %v, want %v", tt.tier, got, tt.want)
+		}
+	}
+}
+
+func TestFlushKeepsCurrentMinute(t *testing.T) {
+	s := openStore(t, t.TempDir())
+	defer s.Close()
+
+	appendSamples(t, s, "a", []sample{{10 * time.Second, 2}})
+
+	err := s.Flush(t0.Add(30 * time.Second))
+	if err != nil {
+		t.Fatalf("Flush: %v", err)
+	}
+
+	segments, err := listSegments(filepath.Join(s.dir, "a"), TierMinute)
+	if err != nil {
+		t.Fatalf("listSegments: %v", err)
+	}
+	if len(segments) != 0 {
+		t.Errorf("incomplete minute written: %v", segments)
+	}
+
+	want := []Bucket{bucket(0, 2, 2, 2, 1)}
+	if got := query(t, s, "a", TierMinute); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestReopenTornRecord(t *testing.T) {
+	tests := []struct {
+		name string
+		torn []byte
+	}{
+		{"short record", make([]byte, recordLen/2)},
+		{"bad checksum", make([]byte, recordLen)},
+		{"truncated valid record", func() []byte {
+			buf := make([]byte, recordLen)
+			encodeRecord(buf, &Bucket{Start: t0.Add(2 * time.Minute), Count: 1})
+			return buf[:recordLen-1]
+		}()},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			s := openStore(t, dir)
+			appendSamples(t, s, "a", rollupSamples[:3])
+			err := s.Flush(t0.Add(2 * time.Minute))
+			if err == nil {
+				err = s.Close()
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			path := segmentPath(filepath.Join(dir, "a"), TierMinute, segmentStart(TierMinute, t0))
+			f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = f.Write(tt.torn)
+			f.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			s = openStore(t, dir)
+			defer s.Close()
+
+			want := rollupTests[0].want[:2]
+			if got := query(t, s, "a", TierMinute); !reflect.DeepEqual(got, want) {
+				t.Fatalf("after reopening: got %v, want %v", got, want)
+			}
+
+			// The torn record is discarded before the next is written
+			appendSamples(t, s, "a", []sample{{3 * time.Minute, 9}})
+			err = s.Flush(t0.Add(4 * time.Minute))
+			if err != nil {
+				t.Fatalf("Flush: %v", err)
+			}
+
+			want = append(want, bucket(3*time.Minute, 9, 9, 9, 1))
+			if got := query(t, s, "a", TierMinute); !reflect.DeepEqual(got, want) {
+				t.Errorf("after appending: got %v, want %v", got, want)
+			}
+
+			info, err := os.Stat(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if info.Size() != 3*recordLen {
+				t.Errorf("segment is %d bytes, want %d", info.Size(), 3*recordLen)
+			}
+		})
+	}
+}
+
+func TestAppendOutOfOrder(t *testing.T) {
+	tests := []struct {
+		name    string
+		before  []time.Duration
+		flushAt time.Duration
+		reopen  bool
+		at      time.Duration
+		want    error
+	}{
+		{"later minute", []time.Duration{time.Minute}, 0, false, 2 * time.Minute, nil},
+		{"earlier in the same minute", []time.Duration{90 * time.Second}, 0, false, 70 * time.Second, nil},
+		{"earlier minute", []time.Duration{2 * time.Minute}, 0, false, time.Minute, ErrOutOfOrder},
+		{"flushed minute", []time.Duration{90 * time.Second}, 3 * time.Minute, false, 100 * time.Second, ErrOutOfOrder},
+		{"after flushed minute", []time.Duration{90 * time.Second}, 3 * time.Minute, false, 2 * time.Minute, nil},
+		{"flushed minute after reopening", []time.Duration{90 * time.Second}, 3 * time.Minute, true, 100 * time.Second, ErrOutOfOrder},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+
+			s := openStore(t, dir)
+			defer func() { s.Close() }()
+
+			for _, at := range tt.before {
+				appendSamples(t, s, "a", []sample{{at, 1}})
+			}
+			if tt.flushAt != 0 {
+				err := s.Flush(t0.Add(tt.flushAt))
+				if err != nil {
+					t.Fatalf("Flush: %v", err)
+				}
+			}
+			if tt.reopen {
+				s.Close()
+				s = openStore(t, dir)
+			}
+
+			err := s.Append("a", t0.Add(tt.at), 1)
+			if !errors.Is(err, tt.want) {
+				t.Errorf("got %v, want %v", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestAppendInvalidName(t *testing.T) {
+	s := openStore(t, t.TempDir())
+	defer s.Close()
+
+	for _, name := range []string{"", ".", "..", "a/b", "a b"} {
+		err := s.Append(name, t0, 1)
+		if !errors.Is(err, ErrInvalidName) {
+			t.Errorf("%q: got %v, want %v", name, err, ErrInvalidName)
+		}
+	}
+}
+
+func TestPrune(t *testing.T) {
+	const day = 24 * time.Hour
+
+	s := openStore(t, t.TempDir())
+	defer s.Close()
+
+	s.SetRetention(TierMinute, 2*day)
+
+	for _, at := range []time.Duration{0, day, 3 * day} {
+		appendSamples(t, s, "a", []sample{{at, 1}})
+		err := s.Flush(t0.Add(at + time.Minute))
+		if err != nil {
+			t.Fatalf("Flush: %v", err)
+		}
+	}
+
+	err := s.Prune(t0.Add(3*day + time.Hour))
+	if err != nil {
+		t.Fatalf("Prune: %v", err)
+	}
+
+	tests := []struct {
+		tier Tier
+		want []time.Time
+	}{
+		{TierMinute, []time.Time{t0.Add(day), t0.Add(3 * day)}},
+		{TierHour, []time.Time{segmentStart(TierHour, t0)}},
+		{TierDay, []time.Time{segmentStart(TierDay, t0)}},
+	}
+
+	for _, tt := range tests {
+		got, err := listSegments(filepath.Join(s.dir, "a"), tt.tier)
+		if err != nil {
+			t.Fatalf("listSegments: %v", err)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("tier %v segments: got %v, want %v", tt.tier, got, tt.want)
+		}
+	}
+
+	want := []Bucket{bucket(day, 1, 1, 1, 1), bucket(3*day, 1, 1, 1, 1)}
+	if got := query(t, s, "a", TierMinute); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestQueryUnknownSeries(t *testing.T) {
+	dir := t.TempDir()
+
+	s := openStore(t, dir)
+	defer s.Close()
+
+	_, err := s.Query("missing", TierMinute, time.Time{}, time.Time{})
+	if !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, want %v", err, ErrNotFound)
+	}
+
+	if len(s.series) != 0 {
+		t.Errorf("query created series %v", s.series)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "missing")); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("query created a directory: %v", err)
+	}
+
+	// Series only held in memory are found
+	appendSamples(t, s, "a", []sample{{10 * time.Second, 2}})
+	want := []Bucket{bucket(0, 2, 2, 2, 1)}
+	if got := query(t, s, "a", TierMinute); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
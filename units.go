@@ -0,0 +1,122 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+
+	"github.com/netleapio/zappy-framework/protocol"
+)
+
+// Unit is the display symbol of a unit of measurement, as used by Home
+// Assistant (eg. "°C", "hPa")
+type Unit string
+
+// Quantity is a value with its unit
+type Quantity struct {
+	Value float64
+	Unit  Unit
+}
+
+func (q Quantity) String() string {
+	s := strconv.FormatFloat(q.Value, 'f', unitInfo[q.Unit].precision, 64)
+	if q.Unit == "" {
+		return s
+	}
+
+	return s + " " + string(q.Unit)
+}
+
+// unitInfo describes every supported unit.  Values are converted from the
+// base (SI) unit of the dimension as (v - offset) / scale.
+var unitInfo = map[Unit]struct {
+	name      string
+	dimension string
+	scale     float64
+	offset    float64
+	precision int
+}{
+	"°C":   {name: "celsius", dimension: "temperature", scale: 1, precision: 2},
+	"°F":   {name: "fahrenheit", dimension: "temperature", scale: 5.0 / 9, offset: -32 * 5.0 / 9, precision: 2},
+	"K":    {name: "kelvin", dimension: "temperature", scale: 1, offset: -273.15, precision: 2},
+	"Pa":   {name: "pascals", dimension: "pressure", scale: 1, precision: 0},
+	"hPa":  {name: "hectopascals", dimension: "pressure", scale: 100, precision: 1},
+	"mbar": {name: "millibars", dimension: "pressure", scale: 100, precision: 1},
+	"inHg": {name: "inches_of_mercury", dimension: "pressure", scale: 3386.389, precision: 2},
+	"V":    {name: "volts", dimension: "voltage", scale: 1, precision: 3},
+	"mV":   {name: "millivolts", dimension: "voltage", scale: 0.001, precision: 0},
+	"W":    {name: "watts", dimension: "power", scale: 1, precision: 1},
+	"kW":   {name: "kilowatts", dimension: "power", scale: 1000, precision: 3},
+	"%":    {name: "percent", dimension: "ratio", scale: 1, precision: 2},
+	"g/m³": {name: "grams_per_cubic_metre", dimension: "density", scale: 1, precision: 2},
+	"d":    {name: "days", dimension: "duration", scale: 1, precision: 0},
+	"s":    {name: "seconds", dimension: "interval", scale: 1, precision: 1},
+	"":     {name: "", dimension: "", scale: 1, precision: 0},
+}
+
+// Units converts readings from their base unit to the configured output
+// unit for their dimension
+type Units struct {
+	output map[string]Unit
+}
+
+// NewUnits creates a converter from config of output unit by dimension,
+// eg. {"temperature": "°F", "pressure": "hPa"}
+func NewUnits(cfg map[string]string) (*Units, error) {
+	u := &Units{output: map[string]Unit{}}
+
+	for dimension, symbol := range cfg {
+		info, ok := unitInfo[Unit(symbol)]
+		if !ok {
+			return nil, fmt.Errorf("unknown unit '%s'", symbol)
+		}
+		if info.dimension != dimension {
+			return nil, fmt.Errorf("unit '%s' is not a unit of %s", symbol, dimension)
+		}
+
+		u.output[dimension] = Unit(symbol)
+	}
+
+	return u, nil
+}
+
+// BaseUnit gets the unit values of a sensor type are stored in
+func BaseUnit(md *protocol.SensorInfo) Unit {
+	for u, info := range unitInfo {
+		if info.name == md.Unit && info.scale == 1 && info.offset == 0 {
+			return u
+		}
+	}
+
+	return ""
+}
+
+// Unit gets the output unit of a sensor type
+func (u *Units) Unit(md *protocol.SensorInfo) Unit {
+	base := BaseUnit(md)
+
+	out, ok := u.output[unitInfo[base].dimension]
+	if !ok {
+		return base
+	}
+
+	return out
+}
+
+// Quantity converts a value of a sensor type to its output unit
+func (u *Units) Quantity(md *protocol.SensorInfo, v float64) Quantity {
+	unit := u.Unit(md)
+	info := unitInfo[unit]
+
+	return Quantity{Value: (v - info.offset) / info.scale, Unit: unit}
+}
+
+// MetricName gets the name of a sensor type with its output unit, such as
+// "temperature_celsius"
+func (u *Units) MetricName(md *protocol.SensorInfo) string {
+	name := unitInfo[u.Unit(md)].name
+	if name == "" {
+		return md.Name
+	}
+
+	return md.Name + "_" + name
+}
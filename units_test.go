@@ -0,0 +1,129 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/netleapio/zappy-framework/protocol"
+)
+
+func TestSensorScaling(t *testing.T) {
+	tests := []struct {
+		sensor protocol.SensorType
+		raw    uint16
+		want   float64
+		unit   Unit
+	}{
+		{protocol.SensorTypeBattVolts, 3300, 3.3, "V"},
+		{protocol.SensorTypeTemperature, 2150, 21.5, "°C"},
+		{protocol.SensorTypePressure, 10132, 101320, "Pa"},
+		{protocol.SensorTypeHumidity, 4550, 45.5, "%"},
+		{protocol.SensorTypeSupplyVolts, 5000, 5, "V"},
+		{protocol.SensorTypeLoadPower, 125, 12.5, "W"},
+		{protocol.SensorTypeCoils, 5, 5, ""},
+		{SensorTypeDewPoint, 12, 12, "°C"},
+		{SensorTypeAbsoluteHumidity, 9, 9, "g/m³"},
+		{SensorTypeHeatIndex, 30, 30, "°C"},
+		{SensorTypeSeaLevelPressure, 65000, 65000, "Pa"},
+		{SensorTypeZoneTemperatureMean, 20, 20, "°C"},
+		{SensorTypeZoneHumidityMax, 60, 60, "%"},
+		{SensorTypeBatteryLevel, 80, 80, "%"},
+		{SensorTypeBatteryDaysRemaining, 120, 120, "d"},
+		{SensorTypePacketLoss, 2, 2, "%"},
+		{SensorTypeReportInterval, 60, 60, "s"},
+	}
+
+	for _, tt := range tests {
+		md := sensorMetadata[tt.sensor]
+		if md == nil {
+			t.Errorf("sensor %v: no metadata", tt.sensor)
+			continue
+		}
+
+		got := sensorValue(md, tt.raw)
+		if math.Abs(got-tt.want) > 1e-9 {
+			t.Errorf("%s: %d scaled to %v, want %v", md.Name, tt.raw, got, tt.want)
+		}
+
+		if unit := BaseUnit(md); unit != tt.unit {
+			t.Errorf("%s: base unit %q, want %q", md.Name, unit, tt.unit)
+		}
+	}
+}
+
+func TestSensorBaseUnits(t *testing.T) {
+	for st, md := range sensorMetadata {
+		if md.Unit != "" && BaseUnit(md) == "" {
+			t.Errorf("sensor %v (%s): unit %q is not a base unit", st, md.Name, md.Unit)
+		}
+	}
+}
+
+func TestUnitConversion(t *testing.T) {
+	temperature := sensorMetadata[protocol.SensorTypeTemperature]
+	pressure := sensorMetadata[protocol.SensorTypePressure]
+	battery := sensorMetadata[protocol.SensorTypeBattVolts]
+	load := sensorMetadata[protocol.SensorTypeLoadPower]
+
+	tests := []struct {
+		dimension string
+		unit      string
+		md        *protocol.SensorInfo
+		v         float64
+		want      float64
+		str       string
+		metric    string
+	}{
+		{"", "", temperature, 21.5, 21.5, "21.50 °C", "temperature_celsius"},
+		{"temperature", "°F", temperature, 20, 68, "68.00 °F", "temperature_fahrenheit"},
+		{"temperature", "°F", temperature, -40, -40, "-40.00 °F", "temperature_fahrenheit"},
+		{"temperature", "K", temperature, 0, 273.15, "273.15 K", "temperature_kelvin"},
+		{"temperature", "K", temperature, -273.15, 0, "0.00 K", "temperature_kelvin"},
+		{"", "", pressure, 101320, 101320, "101320 Pa", "pressure_pascals"},
+		{"pressure", "hPa", pressure, 101330, 1013.3, "1013.3 hPa", "pressure_hectopascals"},
+		{"pressure", "mbar", pressure, 99870, 998.7, "998.7 mbar", "pressure_millibars"},
+		{"pressure", "inHg", pressure, 101325, 29.9213, "29.92 inHg", "pressure_inches_of_mercury"},
+		{"pressure", "inHg", pressure, 3386.389, 1, "1.00 inHg", "pressure_inches_of_mercury"},
+		{"", "", battery, 3.3, 3.3, "3.300 V", "battery_volts"},
+		{"voltage", "mV", battery, 3.3, 3300, "3300 mV", "battery_millivolts"},
+		{"power", "kW", load, 1250, 1.25, "1.250 kW", "load_kilowatts"},
+	}
+
+	for _, tt := range tests {
+		cfg := map[string]string{}
+		if tt.dimension != "" {
+			cfg[tt.dimension] = tt.unit
+		}
+
+		units, err := NewUnits(cfg)
+		if err != nil {
+			t.Fatalf("NewUnits(%v): %v", cfg, err)
+		}
+
+		q := units.Quantity(tt.md, tt.v)
+		if math.Abs(q.Value-tt.want) > 1e-4 {
+			t.Errorf("%s %v in %q: got %v, want %v", tt.md.Name, tt.v, tt.unit, q.Value, tt.want)
+		}
+		if s := q.String(); s != tt.str {
+			t.Errorf("%s %v in %q: got %q, want %q", tt.md.Name, tt.v, tt.unit, s, tt.str)
+		}
+		if name := units.MetricName(tt.md); name != tt.metric {
+			t.Errorf("%s in %q: metric %q, want %q", tt.md.Name, tt.unit, name, tt.metric)
+		}
+	}
+}
+
+func TestNewUnitsErrors(t *testing.T) {
+	tests := []map[string]string{
+		{"temperature": "°R"},
+		{"temperature": "hPa"},
+		{"pressure": "°C"},
+	}
+
+	for _, cfg := range tests {
+		_, err := NewUnits(cfg)
+		if err == nil {
+			t.Errorf("NewUnits(%v): expected error", cfg)
+		}
+	}
+}
@@ -3,15 +3,28 @@ package main
 import (
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/netleapio/zappy-framework/protocol"
 )
 
 type jsonDeviceUpdate struct {
-	DeviceID string
-	Alerts   []string
-	Sensors  map[string]float64
+	DeviceID   string
+	Name       string
+	Model      string
+	Zone       string `json:",omitempty"`
+	Alerts     []string
+	Sensors    map[string]float64
+	Units      map[string]string
+	Precision  map[string]int
+	Updated    map[string]time.Time
+	Stale      []string
+	Diagnostic []string
+}
+
+type jsonPendingUpdate struct {
+	Pending []PendingDevice
 }
 
 type WebSocket struct {
@@ -43,20 +56,50 @@ func (ws *WebSocket) Start() {
 		for {
 			change := <-ws.eventChannel
 
-			if change.Changes|ChangeDeviceUpdate != 0 {
-				device := ws.manager.GetDevice(change.DeviceID)
+			if change.Changes&ChangeDevicePending != 0 {
+				err := conn.WriteJSON(jsonPendingUpdate{Pending: ws.manager.Onboarding().Pending})
+				if err != nil {
+					break
+				}
+				continue
+			}
+
+			if change.Changes&ChangeDeviceUpdate != 0 {
+				device := ws.manager.Snapshot(change.DeviceID)
+				profile := ws.manager.Profile(change.DeviceID)
+				if device == nil || profile == nil {
+					continue
+				}
 
 				msg := jsonDeviceUpdate{
-					DeviceID: strconv.Itoa(int(change.DeviceID)),
-					Alerts:   device.alerts.Strings(),
-					Sensors:  map[string]float64{},
+					DeviceID:   strconv.Itoa(int(change.DeviceID)),
+					Name:       ws.manager.DeviceName(change.DeviceID),
+					Model:      profile.Model,
+					Zone:       device.zone,
+					Alerts:     device.alerts.Strings(),
+					Sensors:    map[string]float64{},
+					Units:      map[string]string{},
+					Precision:  map[string]int{},
+					Updated:    map[string]time.Time{},
+					Stale:      []string{},
+					Diagnostic: []string{},
 				}
 
 				for k, v := range device.sensors {
 					t := protocol.SensorType(k)
-					md := protocol.SensorMetadata[t]
-
-					msg.Sensors[md.Name] = float64(v) * float64(md.Mult) / float64(md.Div)
+					md := sensorMetadata[t]
+
+					q := ws.manager.Units().Quantity(md, v.Value)
+					msg.Sensors[md.Name] = q.Value
+					msg.Units[md.Name] = string(q.Unit)
+					msg.Precision[md.Name] = profile.Precision(t, q.Unit)
+					msg.Updated[md.Name] = v.Received
+					if v.Stale {
+						msg.Stale = append(msg.Stale, md.Name)
+					}
+					if profile.Sensor(t).Diagnostic {
+						msg.Diagnostic = append(msg.Diagnostic, md.Name)
+					}
 				}
 
 				err := conn.WriteJSON(msg)
@@ -0,0 +1,278 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/netleapio/zappy-framework/protocol"
+)
+
+// Sensor types for the aggregate readings of a zone
+const (
+	SensorTypeZoneTemperatureMean protocol.SensorType = 0x90 + iota
+	SensorTypeZoneTemperatureMin
+	SensorTypeZoneTemperatureMax
+	SensorTypeZoneHumidityMax
+	SensorTypeZoneAnyAlert
+)
+
+var zoneSensorMetadata = map[protocol.SensorType]*protocol.SensorInfo{
+	SensorTypeZoneTemperatureMean: {Name: "temperature_mean", Unit: "celsius", Mult: 1, Div: 1},
+	SensorTypeZoneTemperatureMin:  {Name: "temperature_min", Unit: "celsius", Mult: 1, Div: 1},
+	SensorTypeZoneTemperatureMax:  {Name: "temperature_max", Unit: "celsius", Mult: 1, Div: 1},
+	SensorTypeZoneHumidityMax:     {Name: "humidity_max", Unit: "percent", Mult: 1, Div: 1},
+	SensorTypeZoneAnyAlert:        {Name: "any_alert", Unit: "", Mult: 1, Div: 1},
+}
+
+// firstZoneID is the first device ID allocated to zones without a
+// configured ID
+const firstZoneID = 0xFF00
+
+// zone groups devices, publishing their aggregate readings as a virtual
+// device
+type zone struct {
+	name    string
+	id      uint16
+	members map[uint16]bool
+}
+
+func (z *zone) memberIDs() []uint16 {
+	result := make([]uint16, 0, len(z.members))
+	for id := range z.members {
+		result = append(result, id)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i] < result[j] })
+
+	return result
+}
+
+// initZones creates the configured zones, allocating IDs in name order
+// to those without one
+func (m *DeviceManager) initZones(cfg map[string]ZoneSettings) error {
+	names := make([]string, 0, len(cfg))
+	for name := range cfg {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if zs := cfg[name]; zs.ID != nil {
+			err := m.addZone(name, *zs.ID, zs.Devices)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	for _, name := range names {
+		if zs := cfg[name]; zs.ID == nil {
+			id, err := m.nextZoneID()
+			if err != nil {
+				return fmt.Errorf("zone '%s': %w", name, err)
+			}
+
+			err = m.addZone(name, id, zs.Devices)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *DeviceManager) addZone(name string, id uint16, devices []uint16) error {
+	for _, z := range m.zones {
+		if z.id == id {
+			return fmt.Errorf("zone '%s': id %d already used by zone '%s'", name, id, z.name)
+		}
+	}
+
+	if m.deviceIDTaken(id) {
+		return fmt.Errorf("zone '%s': id %d: %w", name, id, ErrDeviceIDInUse)
+	}
+
+	z := &zone{name: name, id: id, members: map[uint16]bool{}}
+	for _, d := range devices {
+		z.members[d] = true
+	}
+	m.zones[name] = z
+
+	return nil
+}
+
+// deviceIDTaken checks whether a real device has an ID, whether tracked
+// now or only registered
+func (m *DeviceManager) deviceIDTaken(id uint16) bool {
+	if d, ok := m.devices[id]; ok && d.zone == "" {
+		return true
+	}
+
+	_, ok := m.registry.Get(id)
+	return ok
+}
+
+// nextZoneID allocates the first free ID from firstZoneID
+func (m *DeviceManager) nextZoneID() (uint16, error) {
+	used := map[uint16]bool{}
+	for _, z := range m.zones {
+		used[z.id] = true
+	}
+
+	for id := firstZoneID; id <= math.MaxUint16; id++ {
+		if !used[uint16(id)] && !m.deviceIDTaken(uint16(id)) {
+			return uint16(id), nil
+		}
+	}
+
+	return 0, errors.New("no free zone ids")
+}
+
+// SetZone creates or updates the members of a zone
+func (m *DeviceManager) SetZone(name string, devices []uint16) error {
+	return m.doLocked(func() error {
+		z, ok := m.zones[name]
+		if !ok {
+			id, err := m.nextZoneID()
+			if err != nil {
+				return err
+			}
+
+			err = m.addZone(name, id, devices)
+			if err != nil {
+				return err
+			}
+			z = m.zones[name]
+		}
+
+		z.members = map[uint16]bool{}
+		for _, d := range devices {
+			z.members[d] = true
+		}
+
+		m.updateZone(z, time.Now())
+		return nil
+	})
+}
+
+// RemoveZone deletes a zone and its virtual device
+func (m *DeviceManager) RemoveZone(name string) bool {
+	found := false
+
+	m.doLocked(func() error {
+		z, ok := m.zones[name]
+		if !ok {
+			return nil
+		}
+
+		found = true
+		delete(m.zones, name)
+
+		if _, ok := m.devices[z.id]; ok {
+			delete(m.devices, z.id)
+			m.notifyListeners(z.id, DeviceChangeTypes(ChangeDeviceGone|ChangeDeviceRemoved))
+		}
+		return nil
+	})
+
+	return found
+}
+
+// Zones gets the members of each zone
+func (m *DeviceManager) Zones() map[string][]uint16 {
+	result := map[string][]uint16{}
+
+	m.doLocked(func() error {
+		for name, z := range m.zones {
+			result[name] = z.memberIDs()
+		}
+		return nil
+	})
+
+	return result
+}
+
+// updateZonesFor recomputes every zone that a device belongs to.  Must be
+// called with the lock held.
+func (m *DeviceManager) updateZonesFor(id uint16, now time.Time) {
+	for _, z := range m.zones {
+		if z.members[id] {
+			m.updateZone(z, now)
+		}
+	}
+}
+
+// updateZone recomputes the aggregate readings of a zone from the fresh
+// readings of its members.  Aggregates with no fresh inputs are marked
+// stale.  Must be called with the lock held.
+func (m *DeviceManager) updateZone(z *zone, now time.Time) {
+	changes := DeviceChangeTypes(ChangeDeviceUpdate)
+
+	d, ok := m.devices[z.id]
+	if !ok {
+		changes |= ChangeNewDevice
+		d = &DeviceState{
+			id:      z.id,
+			zone:    z.name,
+			sensors: map[protocol.SensorType]Reading{},
+		}
+		m.devices[z.id] = d
+	}
+
+	temps := []float64{}
+	humidity := math.Inf(-1)
+	alerts := protocol.AlertNone
+	seen := false
+
+	for id := range z.members {
+		member, ok := m.devices[id]
+		if !ok {
+			continue
+		}
+
+		seen = true
+		alerts |= member.alerts
+
+		if r, ok := member.sensors[protocol.SensorTypeTemperature]; ok && !r.Stale {
+			temps = append(temps, r.Value)
+		}
+		if r, ok := member.sensors[protocol.SensorTypeHumidity]; ok && !r.Stale {
+			humidity = math.Max(humidity, r.Value)
+		}
+	}
+
+	d.lastSeen = now
+	d.alerts = alerts
+
+	set := func(t protocol.SensorType, v float64, ok bool) {
+		if ok {
+			d.sensors[t] = Reading{Value: v, Received: now}
+		} else if r, exists := d.sensors[t]; exists {
+			r.Stale = true
+			d.sensors[t] = r
+		}
+	}
+
+	mean, lowest, highest := 0.0, math.Inf(1), math.Inf(-1)
+	for _, t := range temps {
+		mean += t / float64(len(temps))
+		lowest = math.Min(lowest, t)
+		highest = math.Max(highest, t)
+	}
+
+	anyAlert := 0.0
+	if alerts != protocol.AlertNone {
+		anyAlert = 1
+	}
+
+	set(SensorTypeZoneTemperatureMean, mean, len(temps) > 0)
+	set(SensorTypeZoneTemperatureMin, lowest, len(temps) > 0)
+	set(SensorTypeZoneTemperatureMax, highest, len(temps) > 0)
+	set(SensorTypeZoneHumidityMax, humidity, !math.IsInf(humidity, -1))
+	set(SensorTypeZoneAnyAlert, anyAlert, seen)
+
+	m.notifyListeners(z.id, changes)
+}
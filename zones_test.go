@@ -0,0 +1,37 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRemoveZoneClearsDiscovery(t *testing.T) {
+	mgr, l, broker := newTestMQTT(t, &Config{})
+
+	err := mgr.SetZone("lounge", []uint16{1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var id uint16
+	mgr.doLocked(func() error {
+		id = mgr.zones["lounge"].id
+		return nil
+	})
+	entityPrefix := fmt.Sprintf("/%s_", l.deviceId(id))
+
+	waitFor(t, "zone discovery", func() bool { return len(broker.configs(entityPrefix)) > 0 })
+
+	if !mgr.RemoveZone("lounge") {
+		t.Fatal("zone not found")
+	}
+
+	waitFor(t, "zone discovery to be cleared", func() bool {
+		for _, payload := range broker.configs(entityPrefix) {
+			if payload != "" {
+				return false
+			}
+		}
+		return true
+	})
+}